@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"prospect_file_sync/config"
+)
+
+// 启动管理接口 addr为空时不启动
+func startAdminServer(ac config.AdminConfig) {
+	if len(ac.Addr) == 0 {
+		return
+	}
+	if len(ac.Token) == 0 {
+		panic("admin.token为空! 管理接口必须配置访问令牌")
+	}
+
+	go func() {
+		logger.Printf("admin server listen on %s\r\n", ac.Addr)
+		err := http.ListenAndServe(ac.Addr, newAdminHandler(ac.Token))
+		if err != nil {
+			logger.Printf("admin server error:%s\r\n", err.Error())
+		}
+	}()
+}
+
+func newAdminHandler(token string) http.Handler {
+	api := http.NewServeMux()
+	api.HandleFunc("/api/regions", handleRegions)
+	api.HandleFunc("/api/sync", handleSync)
+	api.HandleFunc("/api/progress", handleProgress)
+	api.HandleFunc("/api/failures", handleFailures)
+	api.HandleFunc("/api/failures/requeue", handleRequeue)
+	api.HandleFunc("/api/scheduler", handleScheduler)
+	api.HandleFunc("/api/scheduler/pause", handleSchedulerPause)
+	api.HandleFunc("/api/scheduler/resume", handleSchedulerResume)
+	api.HandleFunc("/api/history", handleHistory)
+	api.HandleFunc("/api/search", handleSearch)
+	api.HandleFunc("/api/resync", handleResync)
+	api.HandleFunc("/api/trash", handleTrash)
+	api.HandleFunc("/api/trash/restore", handleTrashRestore)
+	api.HandleFunc("/api/versions", handleVersions)
+	api.HandleFunc("/api/versions/restore", handleVersionRestore)
+	api.HandleFunc("/api/guard", handleGuard)
+	api.HandleFunc("/api/guard/approve", handleGuardApprove)
+	api.Handle("/api/metrics", expvar.Handler())
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", requireToken(token, api))
+	mux.Handle("/", dashboardHandler())
+	return mux
+}
+
+// 校验 Authorization: Bearer <token>
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type regionStatus struct {
+	Name    string `json:"name"`
+	Pending int    `json:"pending"`
+	Error   string `json:"error,omitempty"`
+}
+
+// GET 油田列表及待同步log数量
+func handleRegions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	list := make([]regionStatus, 0, len(cfg.Regions))
+	for _, rc := range cfg.Regions {
+		rs := regionStatus{Name: rc.Name}
+		count, err := pendingLogCount(rc)
+		if err != nil {
+			rs.Error = err.Error()
+		}
+		rs.Pending = count
+		list = append(list, rs)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// POST 触发同步 ?region=xx 为空时同步全部油田
+func handleSync(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var regions []config.RegionConfig
+	if name := r.URL.Query().Get("region"); len(name) > 0 {
+		rc, ok := findRegion(name)
+		if !ok {
+			writeError(w, http.StatusNotFound, "region not found")
+			return
+		}
+		regions = []config.RegionConfig{rc}
+	}
+
+	if !runMu.TryLock() {
+		writeError(w, http.StatusConflict, "job is running")
+		return
+	}
+	go func() {
+		defer runMu.Unlock()
+		if regions == nil { // 全部油田与定时job相同
+			runJobLocked()
+		} else {
+			syncRegions(regions)
+		}
+	}()
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "started"})
+}
+
+// GET 当前job进度
+func handleProgress(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, state.getProgress())
+}
+
+// GET 最近的失败记录
+func handleFailures(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, state.listFailures())
+}
+
+// POST 重新同步失败记录 ?id=N
+func handleRequeue(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	f, ok := state.getFailure(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "failure not found")
+		return
+	}
+
+	if !runMu.TryLock() {
+		writeError(w, http.StatusConflict, "job is running")
+		return
+	}
+	defer runMu.Unlock()
+
+	if err := requeueFailure(f); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// GET 定时任务状态
+func handleScheduler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": atomic.LoadInt32(&schedulerPaused) == 1})
+}
+
+// POST 暂停定时任务
+func handleSchedulerPause(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	atomic.StoreInt32(&schedulerPaused, 1)
+	logger.Println("定时任务已暂停")
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": true})
+}
+
+// POST 恢复定时任务
+func handleSchedulerResume(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	atomic.StoreInt32(&schedulerPaused, 0)
+	logger.Println("定时任务已恢复")
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": false})
+}
+
+// GET 各油田执行记录
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, state.listRuns())
+}
+
+// GET 按主键列/存储路径查询各同步表的目标库记录 ?q=xx 结果带油田和同步表
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if len(q) == 0 {
+		writeError(w, http.StatusBadRequest, "q is empty")
+		return
+	}
+	fts, err := searchTargetFiles(q, 100)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, fts)
+}
+
+// POST 重新同步单个文件 ?region=&job=&<主键列>=... 如 &DW=&JH=&WDMC= job为空时为第一个同步表
+func handleResync(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	q := r.URL.Query()
+	rc, ok := findRegion(q.Get("region"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "region not found")
+		return
+	}
+	job, ok := findJob(rc, q.Get("job"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	fl := FileLog{}
+	for _, col := range job.KeyColumns {
+		fl.Keys = append(fl.Keys, KeyValue{Column: col, Value: q.Get(col)})
+	}
+
+	if !runMu.TryLock() {
+		writeError(w, http.StatusConflict, "job is running")
+		return
+	}
+	defer runMu.Unlock()
+
+	if err := resyncItem(rc, job, fl); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// GET 回收站记录
+func handleTrash(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	list, err := listTrash()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// POST 从回收站恢复 ?id=xx
+func handleTrashRestore(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if len(id) == 0 {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	if !runMu.TryLock() {
+		writeError(w, http.StatusConflict, "job is running")
+		return
+	}
+	defer runMu.Unlock()
+
+	if err := restoreTrash(id); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// GET 文档历史版本 ?key=DW-JH-WDMC&region=&job=
+func handleVersions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	q := r.URL.Query()
+	if len(q.Get("key")) == 0 {
+		writeError(w, http.StatusBadRequest, "key is empty")
+		return
+	}
+	list, err := listVersions(q.Get("region"), q.Get("job"), q.Get("key"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// POST 恢复历史版本 ?id=xx
+func handleVersionRestore(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if len(id) == 0 {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	if !runMu.TryLock() {
+		writeError(w, http.StatusConflict, "job is running")
+		return
+	}
+	defer runMu.Unlock()
+
+	if err := restoreVersion(id); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// GET 批量删除拦截记录
+func handleGuard(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	list, err := listDeleteHolds()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// POST 批准油田的批量删除 ?region=xx 下次同步时执行
+func handleGuardApprove(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	region := r.URL.Query().Get("region")
+	if _, ok := findRegion(region); !ok {
+		writeError(w, http.StatusNotFound, "region not found")
+		return
+	}
+	if err := approveDeletes(region); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "approved"})
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
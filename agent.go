@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"prospect_file_sync/config"
+	"prospect_file_sync/util"
+)
+
+// agent模式 部署在油田文件服务器上 代替HFS提供文件下载
+// GET/HEAD /files?path=<CFLJ> CFLJ按roots的前缀映射为本地路径 支持Range 响应头带ETag和sha256
+func runAgent(ac config.AgentConfig) {
+	if len(ac.Addr) == 0 || len(ac.Token) == 0 {
+		logger.Fatalln("agent error: agent.addr和agent.token不能为空")
+	}
+	if len(ac.CertFile) == 0 || len(ac.KeyFile) == 0 {
+		logger.Fatalln("agent error: agent.certFile和agent.keyFile不能为空 agent仅提供https")
+	}
+	if len(ac.Roots) == 0 {
+		logger.Fatalln("agent error: agent.roots为空")
+	}
+
+	logger.Printf("agent listen on %s\r\n", ac.Addr)
+	err := http.ListenAndServeTLS(ac.Addr, ac.CertFile, ac.KeyFile, newAgentHandler(ac))
+	logger.Fatalln("agent error: " + err.Error())
+}
+
+func newAgentHandler(ac config.AgentConfig) http.Handler {
+	h := &agentHandler{roots: ac.Roots, hashes: map[string]fileHash{}}
+	mux := http.NewServeMux()
+	mux.Handle("/files", requireToken(ac.Token, h))
+	return mux
+}
+
+// 文件sha256缓存 大小和修改时间不变时复用
+type fileHash struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+type agentHandler struct {
+	roots []config.MountConfig
+
+	mu     sync.Mutex
+	hashes map[string]fileHash
+}
+
+func (h *agentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	local, ok := agentPath(r.URL.Query().Get("path"), h.roots)
+	if !ok {
+		writeError(w, http.StatusNotFound, "file not found")
+		return
+	}
+	f, err := os.Open(local)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "file not found")
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		writeError(w, http.StatusNotFound, "file not found")
+		return
+	}
+
+	sum, err := h.hash(local, fi)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("ETag", `"`+sum+`"`)
+	w.Header().Set(util.HeaderSHA256, sum)
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+func (h *agentHandler) hash(local string, fi os.FileInfo) (string, error) {
+	h.mu.Lock()
+	c, ok := h.hashes[local]
+	h.mu.Unlock()
+	if ok && c.size == fi.Size() && c.modTime.Equal(fi.ModTime()) {
+		return c.sum, nil
+	}
+
+	sum, err := sha256File(local)
+	if err != nil {
+		return "", err
+	}
+
+	h.mu.Lock()
+	h.hashes[local] = fileHash{size: fi.Size(), modTime: fi.ModTime(), sum: sum}
+	h.mu.Unlock()
+	return sum, nil
+}
+
+// CFLJ映射为本地路径 不能跳出root目录
+func agentPath(cflj string, roots []config.MountConfig) (string, bool) {
+	if len(cflj) == 0 {
+		return "", false
+	}
+	p, ok, err := mountPath(cflj, roots)
+	if err != nil || !ok {
+		return "", false
+	}
+	return p, true
+}
+
+// 油田配置了agent时 CFLJ从agent下载
+func agentUrl(cflj string, ac config.AgentClientConfig) string {
+	return strings.TrimSuffix(ac.Url, "/") + "/files?path=" + url.QueryEscape(cflj)
+}
+
+var agentClients sync.Map // 油田名称 -> *http.Client
+
+// 访问agent的http客户端 带令牌 可指定CA证书
+func agentClient(rc config.RegionConfig) (*http.Client, error) {
+	if len(rc.Agent.Url) == 0 {
+		return nil, nil
+	}
+	if c, ok := agentClients.Load(rc.Name); ok {
+		return c.(*http.Client), nil
+	}
+
+	c, err := tokenClient(rc.Agent.Token, rc.Agent.CAFile, rc.Agent.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	agentClients.Store(rc.Name, c)
+	return c, nil
+}
+
+// 带令牌的http客户端 caFile不为空时用其校验服务器证书
+func tokenClient(token string, caFile string, insecure bool) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if len(caFile) > 0 {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New(caFile + "无有效证书")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: otelhttp.NewTransport(&tokenTransport{token: token, base: transport})}, nil
+}
+
+// 请求带 Authorization: Bearer <token>
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(r)
+}
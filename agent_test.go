@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"prospect_file_sync/config"
+	"prospect_file_sync/util"
+)
+
+func TestAgentHandler(t *testing.T) {
+	dir := filepath.ToSlash(t.TempDir())
+	os.MkdirAll(dir+"/well", 0755)
+	os.WriteFile(dir+"/well/a.pdf", []byte("%PDF-1.4 0123456789"), 0644)
+	os.WriteFile(filepath.Join(filepath.Dir(dir), "secret.txt"), []byte("secret"), 0644)
+
+	ac := config.AgentConfig{Token: "t", Roots: []config.MountConfig{{Prefix: `D:\KTXXWD\`, Path: dir}}}
+	srv := httptest.NewServer(newAgentHandler(ac))
+	defer srv.Close()
+
+	do := func(method string, cflj string, token string, rng string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+"/files?path="+url.QueryEscape(cflj), nil)
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if len(rng) > 0 {
+			req.Header.Set("Range", rng)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := do(http.MethodGet, `D:\KTXXWD\well\a.pdf`, "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("no token status = %d", resp.StatusCode)
+	}
+
+	resp := do(http.MethodHead, `D:\KTXXWD\well\a.pdf`, "t", "")
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != 19 || len(resp.Header.Get(util.HeaderSHA256)) != 64 {
+		t.Errorf("HEAD status = %d length = %d sha256 = %q", resp.StatusCode, resp.ContentLength, resp.Header.Get(util.HeaderSHA256))
+	}
+
+	resp = do(http.MethodGet, `D:\KTXXWD\well\a.pdf`, "t", "bytes=9-")
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || string(data) != "0123456789" {
+		t.Errorf("Range status = %d body = %q", resp.StatusCode, data)
+	}
+
+	// 跳出root目录/目录/未配置前缀 均为404
+	for _, p := range []string{`D:\KTXXWD\..\secret.txt`, `D:\KTXXWD\well`, `E:\other\a.pdf`} {
+		if resp = do(http.MethodGet, p, "t", ""); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s status = %d, want 404", p, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"prospect_file_sync/config"
+	"prospect_file_sync/database"
+)
+
+// 离线包: 物理隔离的油田用移动硬盘传输
+// 油田 export-bundle 导出log、源头库文件详情和文件为tar 目标端 import-bundle 校验后写入并生成确认文件
+// 确认文件带回油田 import-ack 删除已写入的log 未确认的log下次导出时再次导出
+// 目标端对应油田配置push: true 与推送模式相同
+
+const (
+	bundleManifestName = "manifest.json"
+	bundleFileDir      = "files/"
+)
+
+// 离线包清单 tar中最后一项 各文件的大小和sha256为写入tar时计算的值
+type bundleManifest struct {
+	Region    string        `json:"region"`
+	CreatedAt time.Time     `json:"createdAt"`
+	Entries   []pushRequest `json:"entries"`
+}
+
+// 确认文件 已写入(含永久失败)的log
+type bundleAck struct {
+	Region    string     `json:"region"`
+	CreatedAt time.Time  `json:"createdAt"` // 离线包的导出时间
+	Entries   []ackEntry `json:"entries"`
+}
+
+type ackEntry struct {
+	Job       string  `json:"job"`
+	Log       FileLog `json:"log"`
+	Error     string  `json:"error,omitempty"` // 永久失败的原因
+	Permanent bool    `json:"permanent,omitempty"`
+}
+
+// 导出油田全部待同步的log为离线包
+func exportBundle(regionName string, file string) (err error) {
+	rc, ok := findRegion(regionName)
+	if !ok {
+		return fmt.Errorf("region %s not found", regionName)
+	}
+	if isCheckpoint(rc) {
+		return errors.New("离线包不支持consume: checkpoint")
+	}
+	originDB, err := database.ConnectDB(rc.DB)
+	if err != nil {
+		return err
+	}
+	defer originDB.Close()
+
+	ctx := context.Background()
+	m := bundleManifest{Region: rc.Name, CreatedAt: time.Now()}
+	locals := map[string]string{} // 文件ID -> 本地路径
+	for _, job := range regionJobs(rc) {
+		if isTimestampJob(job) {
+			logger.Printf("%s[%s] exportBundle: 时间戳增量同步表不导出\r\n", rc.Name, job.Name)
+			continue
+		}
+		fls, err := loadFileLogs(ctx, originDB, rc, job)
+		if err != nil {
+			return fmt.Errorf("%s: %s", job.Name, err.Error())
+		}
+		for _, fl := range fls {
+			req, local, err := newPushRequest(ctx, originDB, rc, job, fl)
+			if err != nil {
+				// 跳过的log留在MLOG$中 下次导出
+				logger.Printf("%s[%s] %s exportBundle error:%s\r\n", rc.Name, job.Name, fl.KeyString(), err.Error())
+				continue
+			}
+			if req.File != nil {
+				locals[req.File.ID] = local
+			}
+			m.Entries = append(m.Entries, req)
+		}
+	}
+
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(file)
+		}
+	}()
+
+	tw := tar.NewWriter(out)
+	written := map[string]pushFile{}
+	for id, local := range locals {
+		pf, err := writeBundleFile(tw, id, local)
+		if err != nil {
+			return err
+		}
+		written[id] = pf
+	}
+	// 以写入tar的内容为准 导出过程中文件被修改时清单与包内文件仍一致
+	for i, e := range m.Entries {
+		if e.File != nil {
+			pf := written[e.File.ID]
+			m.Entries[i].File = &pf
+		}
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: bundleManifestName, Mode: 0644, Size: int64(len(data)), ModTime: m.CreatedAt}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err = tw.Write(data); err != nil {
+		return err
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+
+	logger.Printf("%s exportBundle:%s %d logs %d files\r\n", rc.Name, file, len(m.Entries), len(written))
+	return nil
+}
+
+// 文件写入tar 边写边计算sha256
+func writeBundleFile(tw *tar.Writer, id string, local string) (pushFile, error) {
+	f, err := os.Open(local)
+	if err != nil {
+		return pushFile{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return pushFile{}, err
+	}
+
+	hdr := &tar.Header{Name: bundleFileDir + id, Mode: 0644, Size: fi.Size(), ModTime: fi.ModTime()}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return pushFile{}, err
+	}
+	s := sha256.New()
+	if _, err = io.CopyN(io.MultiWriter(tw, s), f, fi.Size()); err != nil {
+		return pushFile{}, fmt.Errorf("%s: %s", local, err.Error())
+	}
+	return pushFile{ID: id, Size: fi.Size(), SHA256: hex.EncodeToString(s.Sum(nil)), ModTime: fi.ModTime()}, nil
+}
+
+// 导入离线包 全部文件校验通过后按顺序写入 已写入的log记录到确认文件
+func importBundle(file string, ackFile string) error {
+	if err := os.MkdirAll(cfg.Receiver.Dir, 0755); err != nil {
+		return err
+	}
+	staging, err := ioutil.TempDir(cfg.Receiver.Dir, "bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	m, err := readBundle(file, staging)
+	if err != nil {
+		return err
+	}
+	rc, ok := findRegion(m.Region)
+	if !ok || !rc.Push {
+		return fmt.Errorf("region %s not found or not push mode", m.Region)
+	}
+	if err = verifyBundle(m, staging); err != nil {
+		return err
+	}
+
+	if !runMu.TryLock() {
+		return errReceiverBusy
+	}
+	defer runMu.Unlock()
+
+	// 与拉取时相同检查批量删除拦截 被拦截时各同步表只导入第一条D之前的log 其余不确认 下次导出时再次导入
+	ctx := context.Background()
+	entries := m.Entries
+	if !checkDeleteGuard(ctx, rc, planTasks(rc, entries)) {
+		entries = entriesBeforeDeletes(entries)
+		logger.Printf("%s importBundle: 批量删除已拦截 %d/%d条log本次不导入\r\n", rc.Name, len(m.Entries)-len(entries), len(m.Entries))
+	}
+
+	ack := bundleAck{Region: rc.Name, CreatedAt: m.CreatedAt}
+	failed := 0
+	for _, e := range entries {
+		err := importEntry(ctx, rc, e, staging)
+		if err != nil && !isPermanentError(err) {
+			// 未确认的log留在油田MLOG$中 下次导出时再次导入
+			logger.Printf("%s[%s] %s importBundle error:%s\r\n", rc.Name, e.Job, e.Log.KeyString(), err.Error())
+			failed++
+			continue
+		}
+		a := ackEntry{Job: e.Job, Log: e.Log}
+		if err != nil {
+			a.Error = err.Error()
+			a.Permanent = true
+		}
+		ack.Entries = append(ack.Entries, a)
+	}
+
+	data, err := json.MarshalIndent(ack, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(ackFile, data, 0644); err != nil {
+		return err
+	}
+	logger.Printf("%s importBundle:%s %d acked %d failed ack:%s\r\n", rc.Name, file, len(ack.Entries), failed, ackFile)
+	return nil
+}
+
+// 读取离线包 文件解压到staging 返回清单
+func readBundle(file string, staging string) (bundleManifest, error) {
+	var m bundleManifest
+	f, err := os.Open(file)
+	if err != nil {
+		return m, err
+	}
+	defer f.Close()
+
+	found := false
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return m, err
+		}
+
+		switch {
+		case hdr.Name == bundleManifestName:
+			if err = json.NewDecoder(tr).Decode(&m); err != nil {
+				return m, err
+			}
+			found = true
+		case strings.HasPrefix(hdr.Name, bundleFileDir):
+			id := strings.TrimPrefix(hdr.Name, bundleFileDir)
+			if _, err = hex.DecodeString(id); err != nil || len(id) != sha256.Size*2 {
+				return m, fmt.Errorf("离线包文件名错误:%s", hdr.Name)
+			}
+			out, err := os.Create(path.Join(staging, id))
+			if err != nil {
+				return m, err
+			}
+			_, err = io.Copy(out, tr)
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return m, err
+			}
+		}
+	}
+	if !found {
+		return m, errors.New("离线包缺少" + bundleManifestName)
+	}
+	return m, nil
+}
+
+// 校验清单中全部文件的大小和sha256 有一个不一致时不导入
+func verifyBundle(m bundleManifest, staging string) error {
+	for _, e := range m.Entries {
+		if e.File == nil {
+			continue
+		}
+		p := path.Join(staging, e.File.ID)
+		if size := partSize(p); size != e.File.Size {
+			return fmt.Errorf("离线包文件大小不一致 %s %d/%d", e.File.ID, size, e.File.Size)
+		}
+		sum, err := sha256File(p)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(sum, e.File.SHA256) {
+			return fmt.Errorf("离线包文件sha256不一致 %s %s/%s", e.File.ID, sum, e.File.SHA256)
+		}
+	}
+	return nil
+}
+
+// 写入离线包的一条log 文件复制为上传完成的.part后与推送相同
+func importEntry(ctx context.Context, rc config.RegionConfig, e pushRequest, staging string) error {
+	job, ok := findJob(rc, e.Job)
+	if !ok {
+		return fmt.Errorf("job %s not found", e.Job)
+	}
+	if e.File != nil {
+		part := path.Join(cfg.Receiver.Dir, rc.Name, e.File.ID) + ".part"
+		if err := copyLocalFile(path.Join(staging, e.File.ID), part); err != nil {
+			return err
+		}
+	}
+	return applyPushLocked(ctx, rc, job, e)
+}
+
+// 同beforeDeletes 各同步表只保留第一条D之前的log
+func entriesBeforeDeletes(entries []pushRequest) []pushRequest {
+	held := map[string]bool{}
+	list := make([]pushRequest, 0, len(entries))
+	for _, e := range entries {
+		if e.Log.DMLTYPE == "D" {
+			held[e.Job] = true
+		}
+		if !held[e.Job] {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+func copyLocalFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err = os.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// 油田导入确认文件 删除已写入的log
+func importAck(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var ack bundleAck
+	if err = json.Unmarshal(data, &ack); err != nil {
+		return err
+	}
+	rc, ok := findRegion(ack.Region)
+	if !ok {
+		return fmt.Errorf("region %s not found", ack.Region)
+	}
+
+	originDB, err := database.ConnectDB(rc.DB)
+	if err != nil {
+		return err
+	}
+	defer originDB.Close()
+
+	ctx := context.Background()
+	deleted := 0
+	for _, a := range ack.Entries {
+		job, ok := findJob(rc, a.Job)
+		if !ok {
+			logger.Printf("%s importAck error:job %s not found\r\n", rc.Name, a.Job)
+			continue
+		}
+		if _, err = strconv.ParseInt(a.Log.SEQUENCE, 10, 64); err != nil {
+			logger.Printf("%s importAck error:SEQUENCE$$ %q is not a number\r\n", rc.Name, a.Log.SEQUENCE)
+			continue
+		}
+		if a.Permanent {
+			logger.Printf("%s[%s] %s 永久失败:%s\r\n", rc.Name, a.Job, a.Log.KeyString(), a.Error)
+		}
+		if err = deleteLogRecord(ctx, originDB, a.Log, job.LogTable); err != nil {
+			logger.Printf("%s deleteLogRecord[importAck] error:%s\r\n", rc.Name, err.Error())
+			continue
+		}
+		deleted++
+	}
+
+	logger.Printf("%s importAck:%s %d/%d logs deleted\r\n", rc.Name, file, deleted, len(ack.Entries))
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBundle_readVerify(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "a.pdf")
+	os.WriteFile(local, []byte("%PDF-1.4 0123456789"), 0644)
+	id := pushFileID(`D:\KTXXWD\well\a.pdf`)
+
+	file := filepath.Join(dir, "dq.tar")
+	out, _ := os.Create(file)
+	tw := tar.NewWriter(out)
+	pf, err := writeBundleFile(tw, id, local)
+	if err != nil {
+		t.Fatalf("writeBundleFile() error = %v", err)
+	}
+	m := bundleManifest{Region: "dq", Entries: []pushRequest{
+		{Region: "dq", Job: "atsj87", Log: FileLog{SEQUENCE: "1", DMLTYPE: "I"}, File: &pf},
+		{Region: "dq", Job: "atsj87", Log: FileLog{SEQUENCE: "2", DMLTYPE: "D"}},
+	}}
+	data, _ := json.Marshal(m)
+	tw.WriteHeader(&tar.Header{Name: bundleManifestName, Mode: 0644, Size: int64(len(data))})
+	tw.Write(data)
+	tw.Close()
+	out.Close()
+
+	staging := t.TempDir()
+	got, err := readBundle(file, staging)
+	if err != nil {
+		t.Fatalf("readBundle() error = %v", err)
+	}
+	if got.Region != "dq" || len(got.Entries) != 2 || got.Entries[0].File.SHA256 != pf.SHA256 {
+		t.Fatalf("readBundle() got %+v", got)
+	}
+	if err = verifyBundle(got, staging); err != nil {
+		t.Errorf("verifyBundle() error = %v", err)
+	}
+
+	// 包内文件损坏时不导入
+	os.WriteFile(filepath.Join(staging, id), []byte("%PDF-1.4 9876543210"), 0644)
+	if err = verifyBundle(got, staging); err == nil {
+		t.Errorf("verifyBundle() corrupted error = nil")
+	}
+}
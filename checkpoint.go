@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"prospect_file_sync/config"
+)
+
+// log的消费方式 缺省同步后删除MLOG$记录
+// checkpoint: 不修改MLOG$ 目标库记录各油田各log表已同步的SEQUENCE$$ 下次从SEQUENCE$$ > 检查点处继续
+// 不影响MLOG$的其他使用者(如快速刷新的物化视图) 重置检查点可重新同步历史 仅拉取模式
+// SEQUENCE$$在DML时分配 先分配后提交的事务可能在更大的SEQUENCE$$已同步后才可见 只查询 > 检查点 会永久漏掉
+// 因此每次从 检查点-checkpointOverlap 处重新查询 已同步的SEQUENCE$$记录在<检查点表>_SEEN中 窗口内已同步的跳过
+// 开始记录之前(升级前)的log未记录 窗口起点不早于开始记录时的检查点 晚于窗口提交的事务仍会漏掉
+const consumeCheckpoint = "checkpoint"
+
+const (
+	defaultCheckpointTable   = "SYNC_CHECKPOINT"
+	defaultCheckpointOverlap = 1000
+)
+
+// 检查点 已同步的最大SEQUENCE$$
+type checkpoint struct {
+	Region    string    `db:"REGION" json:"region"`
+	LogTable  string    `db:"LOG_TABLE" json:"logTable"`
+	Sequence  string    `db:"SEQ" json:"sequence"`
+	UpdatedAt time.Time `db:"UPDATED_AT" json:"updatedAt"`
+}
+
+func isCheckpoint(rc config.RegionConfig) bool {
+	return rc.Consume == consumeCheckpoint
+}
+
+func checkpointTable() string {
+	if len(cfg.Target.DB.CheckpointTable) > 0 {
+		return cfg.Target.DB.CheckpointTable
+	}
+	return defaultCheckpointTable
+}
+
+// 检查点之前已同步的SEQUENCE$$
+func checkpointSeenTable() string {
+	return checkpointTable() + "_SEEN"
+}
+
+// 检查点之前重新查询的SEQUENCE$$范围 负数为不重新查询
+func checkpointOverlap(rc config.RegionConfig) int64 {
+	if rc.CheckpointOverlap != 0 {
+		return rc.CheckpointOverlap
+	}
+	return defaultCheckpointOverlap
+}
+
+// 初始化目标库的检查点表
+func ensureCheckpointTable() error {
+	err := ensureTable(fmt.Sprintf(`CREATE TABLE "%s" (
+		REGION VARCHAR2(100),
+		LOG_TABLE VARCHAR2(100),
+		SEQ NUMBER,
+		UPDATED_AT DATE,
+		PRIMARY KEY (REGION, LOG_TABLE)
+	)`, checkpointTable()))
+	if err != nil {
+		return err
+	}
+	return ensureTable(fmt.Sprintf(`CREATE TABLE "%s" (
+		REGION VARCHAR2(100),
+		LOG_TABLE VARCHAR2(100),
+		SEQ NUMBER,
+		PRIMARY KEY (REGION, LOG_TABLE, SEQ)
+	)`, checkpointSeenTable()))
+}
+
+// 查询检查点 无记录时返回空串 从头同步
+func loadCheckpoint(ctx context.Context, region string, logTable string) (string, error) {
+	var seq string
+	sqlStr := fmt.Sprintf(`SELECT TO_CHAR(SEQ) FROM "%s" WHERE REGION = :1 AND LOG_TABLE = :2`, checkpointTable())
+	err := targetDB.GetContext(ctx, &seq, sqlStr, region, logTable)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return seq, err
+}
+
+// 查询检查点及重新查询的窗口 返回查询起点(SEQUENCE$$ > after)和窗口内已同步的SEQUENCE$$
+func loadCheckpointWindow(ctx context.Context, rc config.RegionConfig, logTable string) (string, map[string]bool, error) {
+	cp, err := loadCheckpoint(ctx, rc.Name, logTable)
+	if err != nil || len(cp) == 0 {
+		return cp, nil, err
+	}
+	seq, err := strconv.ParseInt(cp, 10, 64)
+	if err != nil || checkpointOverlap(rc) <= 0 {
+		return cp, nil, nil
+	}
+
+	var first sql.NullInt64
+	sqlStr := fmt.Sprintf(`SELECT MIN(SEQ) FROM "%s" WHERE REGION = :1 AND LOG_TABLE = :2`, checkpointSeenTable())
+	if err = targetDB.GetContext(ctx, &first, sqlStr, rc.Name, logTable); err != nil {
+		return "", nil, err
+	}
+	if !first.Valid {
+		// 开始记录 检查点及之前的log已同步
+		return cp, nil, markSeen(ctx, rc.Name, logTable, cp)
+	}
+
+	// 保留窗口起点及之前最近的一条 使开始记录的位置不随清理后移
+	boundary := seq - checkpointOverlap(rc)
+	sqlStr = fmt.Sprintf(`DELETE FROM "%s" WHERE REGION = :1 AND LOG_TABLE = :2 AND SEQ <
+		(SELECT MAX(SEQ) FROM "%s" WHERE REGION = :3 AND LOG_TABLE = :4 AND SEQ <= :5)`, checkpointSeenTable(), checkpointSeenTable())
+	if _, err = targetDB.ExecContext(ctx, sqlStr, rc.Name, logTable, rc.Name, logTable, boundary); err != nil {
+		logger.Printf("%s checkpoint seen prune error:%s\r\n", rc.Name, err.Error())
+	}
+
+	start := checkpointWindowStart(seq, checkpointOverlap(rc), first.Int64)
+	seqs := []string{}
+	sqlStr = fmt.Sprintf(`SELECT TO_CHAR(SEQ) FROM "%s" WHERE REGION = :1 AND LOG_TABLE = :2 AND SEQ > :3`, checkpointSeenTable())
+	if err = targetDB.SelectContext(ctx, &seqs, sqlStr, rc.Name, logTable, start); err != nil {
+		return "", nil, err
+	}
+	seen := make(map[string]bool, len(seqs))
+	for _, s := range seqs {
+		seen[s] = true
+	}
+	return strconv.FormatInt(start, 10), seen, nil
+}
+
+// 重新查询的起点 检查点-overlap 不早于开始记录已同步SEQUENCE$$的位置first
+func checkpointWindowStart(seq int64, overlap int64, first int64) int64 {
+	start := seq - overlap
+	if first > start {
+		start = first
+	}
+	if start < 0 {
+		start = 0
+	}
+	return start
+}
+
+// 记录已同步的SEQUENCE$$
+func markSeen(ctx context.Context, region string, logTable string, seq string) error {
+	sqlStr := fmt.Sprintf(`MERGE INTO "%s" c USING (SELECT :1 REGION, :2 LOG_TABLE, TO_NUMBER(:3) SEQ FROM dual) s
+		ON (c.REGION = s.REGION AND c.LOG_TABLE = s.LOG_TABLE AND c.SEQ = s.SEQ)
+		WHEN NOT MATCHED THEN INSERT (REGION, LOG_TABLE, SEQ) VALUES (s.REGION, s.LOG_TABLE, s.SEQ)`, checkpointSeenTable())
+	_, err := targetDB.ExecContext(ctx, sqlStr, region, logTable, seq)
+	return err
+}
+
+// 推进检查点 只增不减 重新同步失败记录时不会回退 窗口内晚提交的log只记录为已同步
+func saveCheckpoint(ctx context.Context, region string, logTable string, seq string) (err error) {
+	if len(seq) == 0 {
+		return nil
+	}
+
+	ctx, span := startDBSpan(ctx, "saveCheckpoint", logTable)
+	defer func() { endSpan(span, err) }()
+
+	sqlStr := fmt.Sprintf(`MERGE INTO "%s" c USING (SELECT :1 REGION, :2 LOG_TABLE, TO_NUMBER(:3) SEQ FROM dual) s
+		ON (c.REGION = s.REGION AND c.LOG_TABLE = s.LOG_TABLE)
+		WHEN MATCHED THEN UPDATE SET c.SEQ = s.SEQ, c.UPDATED_AT = SYSDATE WHERE c.SEQ < s.SEQ
+		WHEN NOT MATCHED THEN INSERT (REGION, LOG_TABLE, SEQ, UPDATED_AT) VALUES (s.REGION, s.LOG_TABLE, s.SEQ, SYSDATE)`, checkpointTable())
+	_, err = targetDB.ExecContext(ctx, sqlStr, region, logTable, seq)
+	if err != nil {
+		return err
+	}
+	if err = markSeen(ctx, region, logTable, seq); err != nil {
+		return err
+	}
+
+	logger.Printf("%s checkpoint %s = %s\r\n", region, logTable, seq)
+	return nil
+}
+
+func listCheckpoints() ([]checkpoint, error) {
+	list := []checkpoint{}
+	sqlStr := fmt.Sprintf(`SELECT REGION, LOG_TABLE, TO_CHAR(SEQ) SEQ, UPDATED_AT FROM "%s" ORDER BY REGION, LOG_TABLE`, checkpointTable())
+	err := targetDB.Select(&list, sqlStr)
+	return list, err
+}
+
+// 重置检查点 下次从SEQUENCE$$ > seq处重新同步 seq为0时从头同步
+func resetCheckpoint(region string, logTable string, seq string) error {
+	sqlStr := fmt.Sprintf(`MERGE INTO "%s" c USING (SELECT :1 REGION, :2 LOG_TABLE, TO_NUMBER(:3) SEQ FROM dual) s
+		ON (c.REGION = s.REGION AND c.LOG_TABLE = s.LOG_TABLE)
+		WHEN MATCHED THEN UPDATE SET c.SEQ = s.SEQ, c.UPDATED_AT = SYSDATE
+		WHEN NOT MATCHED THEN INSERT (REGION, LOG_TABLE, SEQ, UPDATED_AT) VALUES (s.REGION, s.LOG_TABLE, s.SEQ, SYSDATE)`, checkpointTable())
+	_, err := targetDB.Exec(sqlStr, region, logTable, seq)
+	if err != nil {
+		return err
+	}
+	// 重新开始记录已同步的SEQUENCE$$ 否则重置后的log被当作已同步跳过
+	_, err = targetDB.Exec(fmt.Sprintf(`DELETE FROM "%s" WHERE REGION = :1 AND LOG_TABLE = :2`, checkpointSeenTable()), region, logTable)
+	if err != nil {
+		return err
+	}
+	logger.Printf("%s checkpoint %s reset to %s\r\n", region, logTable, seq)
+	return nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func Test_checkpointWindowStart(t *testing.T) {
+	tests := []struct {
+		seq, overlap, first int64
+		want                int64
+	}{
+		{5000, 1000, 100, 4000},  // 已记录足够多 从检查点-overlap处重新查询
+		{5000, 1000, 4800, 4800}, // 刚开始记录 不重新查询记录之前的log
+		{500, 1000, 1, 1},
+		{500, 1000, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := checkpointWindowStart(tt.seq, tt.overlap, tt.first); got != tt.want {
+			t.Errorf("checkpointWindowStart(%d, %d, %d) = %d, want %d", tt.seq, tt.overlap, tt.first, got, tt.want)
+		}
+	}
+}
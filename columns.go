@@ -0,0 +1,255 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/godror/godror"
+	"prospect_file_sync/config"
+)
+
+// 默认同步的列 源头库与目标库列名一致
+var defaultColumns = []config.ColumnMapping{
+	{Source: "DW"}, {Source: "JH"}, {Source: "WDMC"}, {Source: "CFLJ"},
+	{Source: "WDLX"}, {Source: "WDZY"}, {Source: "SJLB"}, {Source: "BXDW"},
+	{Source: "BXRQ"}, {Source: "BZ"}, {Source: "LRR"}, {Source: "LRRQ"},
+}
+
+// 文件表一行记录 key为列名(大写) NULL列值为nil
+type FileRow map[string]interface{}
+
+type mapScanner interface {
+	MapScan(dest map[string]interface{}) error
+}
+
+// 扫描一行为FileRow 列名转大写 列值规范化
+func scanFileRow(r mapScanner) (FileRow, error) {
+	raw := map[string]interface{}{}
+	if err := r.MapScan(raw); err != nil {
+		return nil, err
+	}
+
+	row := make(FileRow, len(raw))
+	for k, v := range raw {
+		row[strings.ToUpper(k)] = normalizeValue(v)
+	}
+	return row, nil
+}
+
+// 驱动返回的列值规范化 NULL统一为nil 其余类型(字符串、日期、数值)原样保留
+func normalizeValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case []byte:
+		return string(x)
+	case sql.NullString:
+		if !x.Valid {
+			return nil
+		}
+		return x.String
+	case sql.NullTime:
+		if !x.Valid {
+			return nil
+		}
+		return x.Time
+	case sql.NullInt64:
+		if !x.Valid {
+			return nil
+		}
+		return x.Int64
+	case sql.NullFloat64:
+		if !x.Valid {
+			return nil
+		}
+		return x.Float64
+	default:
+		return v
+	}
+}
+
+// 取字符串列值 NULL返回空串
+func (r FileRow) Str(col string) string {
+	v, ok := r[col]
+	if !ok || v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+// 同步表配置的同步列 target缺省为source 列名统一大写
+func jobColumns(job config.SyncJob) []config.ColumnMapping {
+	cols := job.Columns
+	if len(cols) == 0 {
+		cols = defaultColumns
+	}
+
+	list := make([]config.ColumnMapping, 0, len(cols))
+	for _, c := range cols {
+		c.Source = strings.ToUpper(c.Source)
+		c.Target = strings.ToUpper(c.Target)
+		if len(c.Target) == 0 {
+			c.Target = c.Source
+		}
+		list = append(list, c)
+	}
+	return list
+}
+
+// 源头库查询列 SRC AS TGT
+func originSelectList(cols []config.ColumnMapping) string {
+	items := make([]string, 0, len(cols))
+	for _, c := range cols {
+		items = append(items, c.Source+" AS "+c.Target)
+	}
+	return strings.Join(items, ",")
+}
+
+// 目标库查询列
+func targetSelectList(cols []config.ColumnMapping) string {
+	items := make([]string, 0, len(cols))
+	for _, c := range cols {
+		items = append(items, c.Target)
+	}
+	return strings.Join(items, ",")
+}
+
+// 生成目标库insert语句 使用命名参数 :TGT
+func buildInsertSQL(tableName string, cols []config.ColumnMapping) string {
+	names := make([]string, 0, len(cols))
+	binds := make([]string, 0, len(cols))
+	for _, c := range cols {
+		names = append(names, c.Target)
+		binds = append(binds, ":"+c.Target)
+	}
+	return fmt.Sprintf(`insert into "%s"(%s) values (%s)`, tableName, strings.Join(names, ", "), strings.Join(binds, ", "))
+}
+
+// 生成目标库update语句 主键列和文件路径列不更新 无可更新列时返回空串
+func buildUpdateSQL(tableName string, cols []config.ColumnMapping, job config.SyncJob, where string) string {
+	skip := map[string]bool{job.PathColumn: true}
+	for _, k := range job.KeyColumns {
+		skip[k] = true
+	}
+
+	sets := make([]string, 0, len(cols))
+	for _, c := range cols {
+		if skip[c.Target] {
+			continue
+		}
+		sets = append(sets, c.Target+" =:"+c.Target)
+	}
+	if len(sets) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(`update "%s" set %s where %s`, tableName, strings.Join(sets, ", "), where)
+}
+
+// 对源头库查询结果执行列转换
+func applyTransforms(row FileRow, cols []config.ColumnMapping) error {
+	for _, c := range cols {
+		if len(c.Transform) == 0 {
+			continue
+		}
+		v, err := transformValue(row[c.Target], c.Transform)
+		if err != nil {
+			return fmt.Errorf("column %s: %s", c.Source, err.Error())
+		}
+		row[c.Target] = v
+	}
+	return nil
+}
+
+func transformValue(v interface{}, transform string) (interface{}, error) {
+	s, ok := v.(string)
+	if !ok {
+		return v, nil // 仅处理字符串 NULL及其他类型原样返回
+	}
+
+	switch transform {
+	case "trim":
+		return strings.TrimSpace(s), nil
+	case "upper":
+		return strings.ToUpper(s), nil
+	case "lower":
+		return strings.ToLower(s), nil
+	default:
+		return nil, fmt.Errorf("transform error:%s is not in ['trim','upper','lower']", transform)
+	}
+}
+
+// 列值序列化时保留类型 便于原样写回数据库
+type typedValue struct {
+	Type  string `json:"t"` // null/string/time/number
+	Value string `json:"v,omitempty"`
+}
+
+// FileRow序列化为JSON NULL、空串、日期、数值可还原
+func encodeRow(row FileRow) (string, error) {
+	m := make(map[string]typedValue, len(row))
+	for k, v := range row {
+		switch x := v.(type) {
+		case nil:
+			m[k] = typedValue{Type: "null"}
+		case string:
+			m[k] = typedValue{Type: "string", Value: x}
+		case time.Time:
+			m[k] = typedValue{Type: "time", Value: x.Format(time.RFC3339Nano)}
+		case godror.Number, int64, int, float64:
+			m[k] = typedValue{Type: "number", Value: fmt.Sprint(x)}
+		default:
+			return "", fmt.Errorf("column %s: unsupported type %T", k, v)
+		}
+	}
+	data, err := json.Marshal(m)
+	return string(data), err
+}
+
+// 由encodeRow的结果还原FileRow
+func decodeRow(data string) (FileRow, error) {
+	m := map[string]typedValue{}
+	if err := json.Unmarshal([]byte(data), &m); err != nil {
+		return nil, err
+	}
+
+	row := make(FileRow, len(m))
+	for k, tv := range m {
+		switch tv.Type {
+		case "null":
+			row[k] = nil
+		case "string":
+			row[k] = tv.Value
+		case "time":
+			t, err := time.Parse(time.RFC3339Nano, tv.Value)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %s", k, err.Error())
+			}
+			row[k] = t
+		case "number":
+			row[k] = godror.Number(tv.Value)
+		default:
+			return nil, fmt.Errorf("column %s: unknown type %s", k, tv.Type)
+		}
+	}
+	return row, nil
+}
+
+// 由FileRow的列生成映射 用于写回整行
+func rowColumns(row FileRow) []config.ColumnMapping {
+	names := make([]string, 0, len(row))
+	for k := range row {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	cols := make([]config.ColumnMapping, 0, len(names))
+	for _, n := range names {
+		cols = append(cols, config.ColumnMapping{Source: n, Target: n})
+	}
+	return cols
+}
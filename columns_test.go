@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/godror/godror"
+	"prospect_file_sync/config"
+)
+
+type fakeMapScanner map[string]interface{}
+
+func (f fakeMapScanner) MapScan(dest map[string]interface{}) error {
+	for k, v := range f {
+		dest[k] = v
+	}
+	return nil
+}
+
+func Test_scanFileRow(t *testing.T) {
+	bxrq := time.Date(2023, 5, 6, 0, 0, 0, 0, time.Local)
+	got, err := scanFileRow(fakeMapScanner{
+		"dw":   "dq",                                      // 小写列名
+		"WDMC": []byte("report.pdf"),                      // RAW/字节
+		"WDZY": nil,                                       // NULL 字符串列
+		"BZ":   "",                                        // 空串
+		"BXRQ": bxrq,                                      // 日期
+		"LRRQ": nil,                                       // NULL 日期列
+		"SJLB": godror.Number("12.50"),                    // 数值
+		"BXDW": sql.NullString{},                          // NullString NULL
+		"LRR":  sql.NullString{String: "张三", Valid: true}, // NullString 非NULL
+		"XH":   sql.NullInt64{Int64: 3, Valid: true},
+	})
+	if err != nil {
+		t.Fatalf("scanFileRow() error = %v", err)
+	}
+
+	want := FileRow{
+		"DW":   "dq",
+		"WDMC": "report.pdf",
+		"WDZY": nil,
+		"BZ":   "",
+		"BXRQ": bxrq,
+		"LRRQ": nil,
+		"SJLB": godror.Number("12.50"),
+		"BXDW": nil,
+		"LRR":  "张三",
+		"XH":   int64(3),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("scanFileRow() got = %#v, want %#v", got, want)
+	}
+}
+
+func TestFileRow_Str(t *testing.T) {
+	row := FileRow{"A": "x", "B": nil, "C": godror.Number("1")}
+	tests := []struct {
+		col  string
+		want string
+	}{
+		{"A", "x"},
+		{"B", ""},
+		{"C", "1"},
+		{"MISSING", ""},
+	}
+	for _, tt := range tests {
+		if got := row.Str(tt.col); got != tt.want {
+			t.Errorf("Str(%s) = %v, want %v", tt.col, got, tt.want)
+		}
+	}
+}
+
+func Test_applyTransforms(t *testing.T) {
+	bxrq := time.Date(2023, 5, 6, 0, 0, 0, 0, time.Local)
+	cols := jobColumns(config.SyncJob{Columns: []config.ColumnMapping{
+		{Source: "jh", Transform: "trim"},
+		{Source: "WDZY", Transform: "upper"},
+		{Source: "BXRQ", Transform: "trim"},
+		{Source: "DW", Target: "DWDM", Transform: "lower"},
+	}})
+	row := FileRow{"JH": " D1-1 ", "WDZY": nil, "BXRQ": bxrq, "DWDM": "DQ"}
+
+	if err := applyTransforms(row, cols); err != nil {
+		t.Fatalf("applyTransforms() error = %v", err)
+	}
+	want := FileRow{"JH": "D1-1", "WDZY": nil, "BXRQ": bxrq, "DWDM": "dq"}
+	if !reflect.DeepEqual(row, want) {
+		t.Errorf("applyTransforms() got = %#v, want %#v", row, want)
+	}
+
+	bad := []config.ColumnMapping{{Source: "JH", Target: "JH", Transform: "reverse"}}
+	if err := applyTransforms(FileRow{"JH": "x"}, bad); err == nil {
+		t.Errorf("applyTransforms() unknown transform should return error")
+	}
+}
+
+func Test_buildSQL(t *testing.T) {
+	cols := jobColumns(config.SyncJob{Columns: []config.ColumnMapping{
+		{Source: "DW"},
+		{Source: "lrr", Target: "CJR"},
+	}})
+
+	if got, want := originSelectList(cols), "DW AS DW,LRR AS CJR"; got != want {
+		t.Errorf("originSelectList() = %v, want %v", got, want)
+	}
+	if got, want := targetSelectList(cols), "DW,CJR"; got != want {
+		t.Errorf("targetSelectList() = %v, want %v", got, want)
+	}
+	if got, want := buildInsertSQL("T1", cols), `insert into "T1"(DW, CJR) values (:DW, :CJR)`; got != want {
+		t.Errorf("buildInsertSQL() = %v, want %v", got, want)
+	}
+	job := config.SyncJob{KeyColumns: []string{"DW"}, PathColumn: "CFLJ"}
+	cols = append(cols, config.ColumnMapping{Source: "CFLJ", Target: "CFLJ"})
+	if got, want := buildUpdateSQL("T1", cols, job, "DW =:DW"), `update "T1" set CJR =:CJR where DW =:DW`; got != want {
+		t.Errorf("buildUpdateSQL() = %v, want %v", got, want)
+	}
+	if got := buildUpdateSQL("T1", cols[:1], job, "DW =:DW"); got != "" {
+		t.Errorf("buildUpdateSQL() without columns = %v, want empty", got)
+	}
+	if got := jobColumns(config.SyncJob{}); len(got) != 12 || got[11].Target != "LRRQ" {
+		t.Errorf("jobColumns() default = %v", got)
+	}
+}
+
+func Test_fileLogFromRow(t *testing.T) {
+	row := FileRow{"DW": nil, "JH": "D1-1", "WDMC": "a.pdf", "SEQUENCE$$": godror.Number("42"), "DMLTYPE$$": "I"}
+	want := FileLog{
+		Keys:     []KeyValue{{"DW", ""}, {"JH", "D1-1"}, {"WDMC", "a.pdf"}},
+		SEQUENCE: "42",
+		DMLTYPE:  "I",
+	}
+	if got := fileLogFromRow(row, defaultKeyColumns); !reflect.DeepEqual(got, want) {
+		t.Errorf("fileLogFromRow() = %v, want %v", got, want)
+	}
+
+	got := fileLogFromRow(FileRow{"WDID": godror.Number("1001"), "SEQUENCE$$": "7", "DMLTYPE$$": "D"}, []string{"WDID"})
+	if got.KeyString() != "1001" || got.keyWhere() != "WDID =:WDID" || got.keyArgs()["WDID"] != "1001" {
+		t.Errorf("fileLogFromRow() custom key = %v", got)
+	}
+}
+
+func Test_encodeRow(t *testing.T) {
+	bxrq := time.Date(2023, 5, 6, 7, 8, 9, 0, time.Local)
+	row := FileRow{
+		"WDMC": "a.pdf",
+		"BZ":   "",
+		"WDZY": nil,
+		"BXRQ": bxrq,
+		"SJLB": godror.Number("12.50"),
+	}
+
+	data, err := encodeRow(row)
+	if err != nil {
+		t.Fatalf("encodeRow() error = %v", err)
+	}
+	got, err := decodeRow(data)
+	if err != nil {
+		t.Fatalf("decodeRow() error = %v", err)
+	}
+
+	if got["WDMC"] != "a.pdf" || got["BZ"] != "" || got["WDZY"] != nil || got["SJLB"] != godror.Number("12.50") {
+		t.Errorf("decodeRow() got = %#v", got)
+	}
+	if tm, ok := got["BXRQ"].(time.Time); !ok || !tm.Equal(bxrq) {
+		t.Errorf("decodeRow() BXRQ = %#v, want %v", got["BXRQ"], bxrq)
+	}
+	if _, ok := got["WDZY"]; !ok {
+		t.Errorf("decodeRow() lost NULL column")
+	}
+}
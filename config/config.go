@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -28,16 +29,49 @@ func init() {
 // cfg 缺省设置
 func NewConfigWithDefault() Config {
 	c := Config{
-		Profile: "dev",
-		Cron:    "0 0 1 * * ?",
+		Profile:          "dev",
+		Cron:             "0 0 1 * * ?",
+		ProgressInterval: 30 * time.Second,
+		Tracing: TracingConfig{
+			ServiceName: "prospect_file_sync",
+			File:        "./traces.json",
+		},
+		Trash: TrashConfig{
+			Dir:       "./trash",
+			Retention: 30 * 24 * time.Hour,
+		},
+		Versioning: VersioningConfig{
+			Dir:         "./versions",
+			MaxVersions: 5,
+		},
+		Receiver: ReceiverConfig{
+			Dir: "./push",
+		},
+		Push: PushConfig{
+			ChunkSize: 4 << 20,
+		},
 	}
 	return c
 }
 
 type Config struct {
-	Profile string       `yaml:"profile"` // 执行环境 dev/prod/history/org
-	Cron    string       `yaml:"cron"`    // cron
-	Target  RegionConfig `yaml:"target"`  // 目标服务器和数据库
+	Profile string        `yaml:"profile"` // 执行环境 dev/prod/history/org
+	Cron    string        `yaml:"cron"`    // cron
+	Target  RegionConfig  `yaml:"target"`  // 目标服务器和数据库
+	Admin   AdminConfig   `yaml:"admin"`   // 管理接口
+	Tracing TracingConfig `yaml:"tracing"` // 链路追踪
+	Trash   TrashConfig   `yaml:"trash"`   // 回收站
+
+	Versioning  VersioningConfig  `yaml:"versioning"`  // 文档历史版本
+	DeleteGuard DeleteGuardConfig `yaml:"deleteGuard"` // 批量删除拦截
+	FtpServer   FtpServerConfig   `yaml:"ftpServer"`   // 内置只读FTP服务
+	Agent       AgentConfig       `yaml:"agent"`       // agent模式(prospect_file_sync agent) 油田文件服务
+	Receiver    ReceiverConfig    `yaml:"receiver"`    // 接收油田agent推送的文件和记录
+	Push        PushConfig        `yaml:"push"`        // 推送模式(prospect_file_sync push) 油田主动推送到receiver
+
+	Hooks []HookConfig `yaml:"hooks"` // 文件落盘/删除前后执行的外部命令
+
+	ProgressInterval time.Duration `yaml:"progressInterval"` // 下载进度输出间隔 如 30s 0为不输出
 
 	Regions []RegionConfig `yaml:"regions"`
 }
@@ -53,15 +87,195 @@ type RegionConfig struct {
 	ClientSecret    string `yaml:"client_secret"`   // 新疆登录接口client_secret
 	FileDownloadUrl string `yaml:"fileDownloadUrl"` // 新疆文件下载接口
 	DB              DB     `yaml:"db"`
+
+	Columns []ColumnMapping `yaml:"columns"` // 同步的列 为空时使用默认列
+	Jobs    []SyncJob       `yaml:"jobs"`    // 同步的表 为空时使用db.logTable/db.fileTable和target.db.fileTable
+
+	Validation ValidationConfig  `yaml:"validation"` // 下载内容校验
+	Ftp        FtpConfig         `yaml:"ftp"`        // CFLJ为ftp://或ftps://地址时的FTP连接
+	Sftp       SftpConfig        `yaml:"sftp"`       // 油田: CFLJ为sftp://地址时的SSH连接 target: 落盘到SFTP服务器
+	Mounts     []MountConfig     `yaml:"mounts"`     // CFLJ前缀映射为本地/挂载路径 匹配时直接复制文件 不经HTTP
+	Agent      AgentClientConfig `yaml:"agent"`      // 油田部署了agent时从agent下载 代替baseUrl/rootDir
+	Push       bool              `yaml:"push"`       // 推送模式: 不拉取 由油田agent推送到receiver
+	Segment    SegmentConfig     `yaml:"segment"`    // 大文件分段并发下载
+	Consume    string            `yaml:"consume"`    // log消费方式 缺省删除MLOG$记录 checkpoint: 不修改MLOG$ 目标库记录检查点
+
+	CheckpointOverlap int64 `yaml:"checkpointOverlap"` // checkpoint消费方式 检查点之前重新查询的SEQUENCE$$范围 发现晚提交的事务 缺省1000 负数为不重新查询
+}
+
+// 分段下载配置 源服务器(HFS/agent)须支持Range
+type SegmentConfig struct {
+	Parts     int   `yaml:"parts"`     // 并发段数 小于2时不分段
+	Threshold int64 `yaml:"threshold"` // 文件大小(字节)达到该值时分段 0为不分段
+}
+
+// CFLJ路径前缀映射 如 D:\KTXXWD\ -> /mnt/ktxxwd/
+type MountConfig struct {
+	Prefix string `yaml:"prefix"` // CFLJ前缀 不区分大小写和\/
+	Path   string `yaml:"path"`   // 本机可访问的路径
+}
+
+// FTP/FTPS连接配置 被动模式 CFLJ中带用户名密码时以CFLJ为准
+type FtpConfig struct {
+	Username           string        `yaml:"username"` // 为空时匿名登录
+	Password           string        `yaml:"password"`
+	ExplicitTLS        bool          `yaml:"explicitTLS"`        // ftp://使用AUTH TLS ftps://总是隐式TLS
+	InsecureSkipVerify bool          `yaml:"insecureSkipVerify"` // 不校验服务器证书
+	Timeout            time.Duration `yaml:"timeout"`            // 连接超时 缺省30s
+}
+
+// 下载内容校验 已知二进制扩展名(pdf/doc/jpg等)总是校验文件头并拒绝HTML页面
+type ValidationConfig struct {
+	MaxSize  int64    `yaml:"maxSize"`  // 文件大小上限(字节) 0为不限
+	AllowExt []string `yaml:"allowExt"` // 扩展名白名单 为空时不限制 如 [pdf, doc, docx]
+	DenyExt  []string `yaml:"denyExt"`  // 扩展名黑名单 如 [exe, bat]
+}
+
+// 一组同步表 log表+源头文件表 -> 目标文件表
+type SyncJob struct {
+	Name        string          `yaml:"name"`
+	LogTable    string          `yaml:"logTable"`    // 源头库物化视图日志表 MLOG$_XXX
+	FileTable   string          `yaml:"fileTable"`   // 源头库文件表
+	TargetTable string          `yaml:"targetTable"` // 目标库文件表
+	KeyColumns  []string        `yaml:"keyColumns"`  // 主键列 缺省DW,JH,WDMC 源头库与目标库列名一致
+	PathColumn  string          `yaml:"pathColumn"`  // 文件路径列(目标库列名) 缺省CFLJ
+	StoreDir    string          `yaml:"storeDir"`    // 落盘子目录 可选 避免不同表的同名文件冲突
+	Columns     []ColumnMapping `yaml:"columns"`     // 同步的列 为空时使用默认列
+	Timestamp   TimestampConfig `yaml:"timestamp"`   // 按修改时间增量同步 配置后不使用logTable
+}
+
+// 时间戳增量同步 源头库无物化视图日志时按修改时间列轮询源头文件表
+type TimestampConfig struct {
+	Column       string        `yaml:"column"`       // 源头库修改时间列 如 LRRQ
+	Overlap      time.Duration `yaml:"overlap"`      // 重叠窗口 从水位线之前该时长处查询 避免漏掉未提交的修改 缺省10m
+	DiffInterval time.Duration `yaml:"diffInterval"` // 主键全量比对的间隔 发现源头库已删除的记录和修改时间为空的新记录 0为不比对
+}
+
+// 源头库列到目标库列的映射
+type ColumnMapping struct {
+	Source    string `yaml:"source"`    // 源头库列名
+	Target    string `yaml:"target"`    // 目标库列名 为空时与source相同
+	Transform string `yaml:"transform"` // 可选转换 trim/upper/lower
 }
 
 // oracle数据库配置
 type DB struct {
-	Host        string `yaml:"host"`
-	Port        int    `yaml:"port"`
-	Username    string `yaml:"username"`
-	Password    string `yaml:"password"`
-	ServiceName string `yaml:"serviceName"`
-	LogTable    string `yaml:"logTable"`
-	FileTable   string `yaml:"fileTable"`
+	Host            string `yaml:"host"`
+	Port            int    `yaml:"port"`
+	Username        string `yaml:"username"`
+	Password        string `yaml:"password"`
+	ServiceName     string `yaml:"serviceName"`
+	LogTable        string `yaml:"logTable"`
+	FileTable       string `yaml:"fileTable"`
+	MetaTable       string `yaml:"metaTable"`       // 仅目标库 已落盘文件的ETag/Last-Modified/大小 缺省SYNC_FILE_META
+	CheckpointTable string `yaml:"checkpointTable"` // 仅目标库 checkpoint消费方式的检查点 缺省SYNC_CHECKPOINT
+	WatermarkTable  string `yaml:"watermarkTable"`  // 仅目标库 时间戳增量同步的水位线 缺省SYNC_WATERMARK
+	RunTable        string `yaml:"runTable"`        // 仅目标库 管理页面的执行记录 缺省SYNC_RUN_HISTORY
+	FailureTable    string `yaml:"failureTable"`    // 仅目标库 管理页面的失败记录 缺省SYNC_FAILURE
+}
+
+// 管理接口配置 addr为空时不启动
+type AdminConfig struct {
+	Addr  string `yaml:"addr"`  // 监听地址 如 :8090
+	Token string `yaml:"token"` // 接口访问令牌 Authorization: Bearer <token>
+}
+
+// 链路追踪配置 exporter为空时不导出
+type TracingConfig struct {
+	Exporter    string `yaml:"exporter"`    // otlp/file
+	Endpoint    string `yaml:"endpoint"`    // otlp http地址 如 localhost:4318
+	Insecure    bool   `yaml:"insecure"`    // otlp 不使用https
+	File        string `yaml:"file"`        // file exporter 输出文件 离线环境使用
+	ServiceName string `yaml:"serviceName"` // 服务名
+}
+
+// 回收站配置 删除或被替换的文件先移入回收站 超过保留期后清理
+type TrashConfig struct {
+	Dir       string        `yaml:"dir"`       // 回收站目录 按日期分子目录
+	Retention time.Duration `yaml:"retention"` // 保留期 如 720h 0为不清理
+	Table     string        `yaml:"table"`     // 目标库回收站表 缺省SYNC_TRASH
+}
+
+// 历史版本配置 enabled时U替换的旧文件保留为历史版本 不移入回收站
+type VersioningConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	Dir         string `yaml:"dir"`         // 历史版本目录
+	MaxVersions int    `yaml:"maxVersions"` // 每个文档最多保留的版本数 0为不限
+	Table       string `yaml:"table"`       // 目标库历史版本表 缺省SYNC_FILE_VERSION
+}
+
+// 批量删除拦截配置 一次同步中某油田待删除数量超过阈值时暂停删除 等待批准
+type DeleteGuardConfig struct {
+	MaxDeletes int     `yaml:"maxDeletes"` // 待删除数量上限 0为不检查
+	MaxPercent float64 `yaml:"maxPercent"` // 待删除数量占本油田目标表记录数的百分比上限 0为不检查
+	NotifyUrl  string  `yaml:"notifyUrl"`  // 拦截时POST通知的地址 可选
+	Table      string  `yaml:"table"`      // 目标库拦截记录表 缺省SYNC_DELETE_GUARD
+}
+
+// 外部命令 文件信息通过环境变量SYNC_*和stdin JSON传入
+type HookConfig struct {
+	Event   string        `yaml:"event"`   // preStore/postStore/postDelete
+	Command []string      `yaml:"command"` // 命令及参数 如 [clamscan, --no-summary]
+	Timeout time.Duration `yaml:"timeout"` // 超时 缺省1m
+	OnError string        `yaml:"onError"` // fail: 该文件同步失败(缺省) warn: 仅记录日志
+}
+
+// SFTP连接配置 私钥和密码可同时配置 须配置knownHostsFile校验服务器公钥
+type SftpConfig struct {
+	Addr           string        `yaml:"addr"` // 仅target 如 10.21.2.3:22 配置后rootDir为SFTP服务器上的目录
+	Username       string        `yaml:"username"`
+	Password       string        `yaml:"password"`
+	PrivateKeyFile string        `yaml:"privateKeyFile"` // 私钥文件
+	Passphrase     string        `yaml:"passphrase"`     // 私钥密码 可选
+	KnownHostsFile string        `yaml:"knownHostsFile"` // known_hosts文件
+	InsecureHost   bool          `yaml:"insecureHost"`   // 不校验服务器公钥 仅测试环境使用
+	Timeout        time.Duration `yaml:"timeout"`        // 连接超时 缺省30s
+}
+
+// 内置只读FTP服务配置 addr为空时不启动 以target.rootDir为根目录
+type FtpServerConfig struct {
+	Addr         string    `yaml:"addr"`         // 监听地址 如 :21
+	PublicHost   string    `yaml:"publicHost"`   // 被动模式返回给客户端的IP 可选
+	PassivePorts string    `yaml:"passivePorts"` // 被动模式端口范围 如 50000-50100 为空时随机
+	Users        []FtpUser `yaml:"users"`        // 账号 至少一个
+}
+
+type FtpUser struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// agent模式配置 部署在油田文件服务器 仅提供https
+type AgentConfig struct {
+	Addr     string        `yaml:"addr"`     // 监听地址 如 :8443
+	CertFile string        `yaml:"certFile"` // https证书
+	KeyFile  string        `yaml:"keyFile"`  // https私钥
+	Token    string        `yaml:"token"`    // 访问令牌 Authorization: Bearer <token>
+	Roots    []MountConfig `yaml:"roots"`    // 对外提供的目录 CFLJ前缀 -> 本地目录
+}
+
+// 同步端访问油田agent的配置
+type AgentClientConfig struct {
+	Url                string `yaml:"url"`                // 如 https://10.21.3.4:8443
+	Token              string `yaml:"token"`              // 与agent.token一致
+	CAFile             string `yaml:"caFile"`             // 校验agent证书的CA 可选
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"` // 不校验agent证书
+}
+
+// 推送接收端配置 addr为空时不启动 certFile为空时使用http
+type ReceiverConfig struct {
+	Addr     string `yaml:"addr"`     // 监听地址 如 :8444
+	CertFile string `yaml:"certFile"` // https证书
+	KeyFile  string `yaml:"keyFile"`  // https私钥
+	Token    string `yaml:"token"`    // 访问令牌 与油田push.token一致
+	Dir      string `yaml:"dir"`      // 上传文件暂存目录 缺省./push
+}
+
+// 推送模式配置 油田agent读取本地MLOG$和源头表 推送到receiver
+type PushConfig struct {
+	Url                string `yaml:"url"`                // receiver地址 如 https://10.0.0.1:8444
+	Token              string `yaml:"token"`              // 与receiver.token一致
+	CAFile             string `yaml:"caFile"`             // 校验receiver证书的CA 可选
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"` // 不校验receiver证书
+	ChunkSize          int64  `yaml:"chunkSize"`          // 分块上传大小(字节) 缺省4MB
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	ftpserver "github.com/fclairamb/ftpserverlib"
+	"github.com/spf13/afero"
+	"prospect_file_sync/config"
+)
+
+// 启动内置只读FTP服务 addr为空时不启动
+// 以target.rootDir为根目录 ftpPrefix的路径部分(如 /KTXXWD)映射到根目录 使写入目标库的FTP地址可直接访问
+func startFtpServer(fc config.FtpServerConfig, target config.RegionConfig) {
+	if len(fc.Addr) == 0 {
+		return
+	}
+	if len(target.Sftp.Addr) > 0 {
+		logger.Fatalln("ftpServer error: 仅支持本地落盘 target.sftp已配置")
+	}
+
+	srv, err := newFtpServer(fc, target.RootDir, target.FtpPrefix)
+	if err != nil {
+		logger.Fatalln("ftpServer init error: " + err.Error())
+	}
+	if err = srv.Listen(); err != nil {
+		logger.Fatalln("ftpServer listen error: " + err.Error())
+	}
+
+	go func() {
+		logger.Printf("ftp server listen on %s\r\n", srv.Addr())
+		if err := srv.Serve(); err != nil {
+			logger.Printf("ftp server error:%s\r\n", err.Error())
+		}
+	}()
+}
+
+func newFtpServer(fc config.FtpServerConfig, rootDir string, ftpPrefix string) (*ftpserver.FtpServer, error) {
+	if len(fc.Users) == 0 {
+		return nil, errors.New("ftpServer.users为空")
+	}
+
+	settings := &ftpserver.Settings{
+		ListenAddr: fc.Addr,
+		PublicHost: fc.PublicHost,
+		Banner:     "prospect_file_sync",
+	}
+	if len(fc.PassivePorts) > 0 {
+		pr, err := parsePortRange(fc.PassivePorts)
+		if err != nil {
+			return nil, err
+		}
+		settings.PassiveTransferPortRange = pr
+	}
+
+	prefix := ""
+	if u, err := url.Parse(ftpPrefix); err == nil {
+		prefix = strings.TrimSuffix(u.Path, "/")
+	}
+	fs := &prefixFs{
+		Fs:     afero.NewReadOnlyFs(afero.NewBasePathFs(afero.NewOsFs(), rootDir)),
+		prefix: prefix,
+	}
+	return ftpserver.NewFtpServer(&ftpDriver{settings: settings, users: fc.Users, fs: fs}), nil
+}
+
+// 被动模式端口范围 如 50000-50100
+func parsePortRange(s string) (*ftpserver.PortRange, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("passivePorts error:%s is not start-end", s)
+	}
+	start, err1 := strconv.Atoi(strings.TrimSpace(parts[0]))
+	end, err2 := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err1 != nil || err2 != nil || start <= 0 || end < start {
+		return nil, fmt.Errorf("passivePorts error:%s is not start-end", s)
+	}
+	return &ftpserver.PortRange{Start: start, End: end}, nil
+}
+
+type ftpDriver struct {
+	settings *ftpserver.Settings
+	users    []config.FtpUser
+	fs       afero.Fs
+}
+
+func (d *ftpDriver) GetSettings() (*ftpserver.Settings, error) {
+	return d.settings, nil
+}
+
+func (d *ftpDriver) ClientConnected(cc ftpserver.ClientContext) (string, error) {
+	return "prospect_file_sync ftp (read only)", nil
+}
+
+func (d *ftpDriver) ClientDisconnected(cc ftpserver.ClientContext) {}
+
+func (d *ftpDriver) AuthUser(cc ftpserver.ClientContext, user, pass string) (ftpserver.ClientDriver, error) {
+	for _, u := range d.users {
+		if u.Username == user && subtle.ConstantTimeCompare([]byte(u.Password), []byte(pass)) == 1 {
+			return d.fs, nil
+		}
+	}
+	return nil, errors.New("invalid username or password")
+}
+
+func (d *ftpDriver) GetTLSConfig() (*tls.Config, error) {
+	return nil, errors.New("tls not supported")
+}
+
+// 去掉ftpPrefix的路径前缀后访问根目录 不带前缀的路径同样可以访问
+type prefixFs struct {
+	afero.Fs
+	prefix string
+}
+
+func (f *prefixFs) name(name string) string {
+	if len(f.prefix) == 0 {
+		return name
+	}
+	name = path.Clean("/" + name)
+	if strings.EqualFold(name, f.prefix) {
+		return "/"
+	}
+	if len(name) > len(f.prefix) && strings.EqualFold(name[:len(f.prefix)+1], f.prefix+"/") {
+		return name[len(f.prefix):]
+	}
+	return name
+}
+
+func (f *prefixFs) Create(name string) (afero.File, error) { return f.Fs.Create(f.name(name)) }
+
+func (f *prefixFs) Mkdir(name string, perm os.FileMode) error { return f.Fs.Mkdir(f.name(name), perm) }
+
+func (f *prefixFs) MkdirAll(p string, perm os.FileMode) error { return f.Fs.MkdirAll(f.name(p), perm) }
+
+func (f *prefixFs) Open(name string) (afero.File, error) { return f.Fs.Open(f.name(name)) }
+
+func (f *prefixFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	return f.Fs.OpenFile(f.name(name), flag, perm)
+}
+
+func (f *prefixFs) Remove(name string) error { return f.Fs.Remove(f.name(name)) }
+
+func (f *prefixFs) RemoveAll(p string) error { return f.Fs.RemoveAll(f.name(p)) }
+
+func (f *prefixFs) Rename(oldname, newname string) error {
+	return f.Fs.Rename(f.name(oldname), f.name(newname))
+}
+
+func (f *prefixFs) Stat(name string) (os.FileInfo, error) { return f.Fs.Stat(f.name(name)) }
+
+func (f *prefixFs) Chmod(name string, mode os.FileMode) error { return f.Fs.Chmod(f.name(name), mode) }
+
+func (f *prefixFs) Chown(name string, uid, gid int) error { return f.Fs.Chown(f.name(name), uid, gid) }
+
+func (f *prefixFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return f.Fs.Chtimes(f.name(name), atime, mtime)
+}
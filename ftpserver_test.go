@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+	"prospect_file_sync/config"
+)
+
+func Test_newFtpServer(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "cnpc_dq", "X1"), 0755)
+	os.WriteFile(filepath.Join(root, "cnpc_dq", "X1", "a.pdf"), []byte("%PDF-1.4"), 0644)
+
+	fc := config.FtpServerConfig{
+		Addr:  "127.0.0.1:0",
+		Users: []config.FtpUser{{Username: "ktxx", Password: "secret"}},
+	}
+	srv, err := newFtpServer(fc, root, "FTP://10.21.2.3/KTXXWD")
+	if err != nil {
+		t.Fatalf("newFtpServer() error = %v", err)
+	}
+	if err = srv.Listen(); err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	go srv.Serve()
+	defer srv.Stop()
+
+	bad, err := ftp.Dial(srv.Addr(), ftp.DialWithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	if err = bad.Login("ktxx", "wrong"); err == nil {
+		t.Errorf("Login() with wrong password error = nil")
+	}
+	bad.Quit()
+
+	c, err := ftp.Dial(srv.Addr(), ftp.DialWithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Quit()
+	if err = c.Login("ktxx", "secret"); err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+
+	// ftpPrefix的路径部分映射到根目录
+	for _, p := range []string{"/KTXXWD/cnpc_dq/X1/a.pdf", "/cnpc_dq/X1/a.pdf"} {
+		resp, err := c.Retr(p)
+		if err != nil {
+			t.Fatalf("Retr(%s) error = %v", p, err)
+		}
+		data, _ := io.ReadAll(resp)
+		resp.Close()
+		if string(data) != "%PDF-1.4" {
+			t.Errorf("Retr(%s) got %q", p, data)
+		}
+	}
+
+	// 只读
+	if err = c.Stor("/KTXXWD/b.txt", bytes.NewReader([]byte("x"))); err == nil {
+		t.Errorf("Stor() error = nil, want read only")
+	}
+	if _, err = os.Stat(filepath.Join(root, "b.txt")); err == nil {
+		t.Errorf("Stor() wrote file")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"prospect_file_sync/config"
+)
+
+const defaultGuardTable = "SYNC_DELETE_GUARD"
+
+// 油田的批量删除拦截记录 STATUS: PENDING等待批准/APPROVED已批准
+type deleteHold struct {
+	Region     string       `db:"REGION" json:"region"`
+	Deletes    int          `db:"PENDING_DELETES" json:"deletes"` // 拦截时待删除的数量 批准后允许删除的上限
+	Total      int          `db:"TARGET_TOTAL" json:"total"`      // 拦截时本油田在目标表的记录数
+	Status     string       `db:"STATUS" json:"status"`
+	DetectedAt time.Time    `db:"DETECTED_AT" json:"detectedAt"`
+	ApprovedAt sql.NullTime `db:"APPROVED_AT" json:"-"`
+}
+
+func guardTable() string {
+	if len(cfg.DeleteGuard.Table) > 0 {
+		return cfg.DeleteGuard.Table
+	}
+	return defaultGuardTable
+}
+
+// 初始化目标库的批量删除拦截表
+func ensureGuardTable() error {
+	return ensureTable(fmt.Sprintf(`CREATE TABLE "%s" (
+		REGION VARCHAR2(100) PRIMARY KEY,
+		PENDING_DELETES NUMBER,
+		TARGET_TOTAL NUMBER,
+		STATUS VARCHAR2(20),
+		DETECTED_AT DATE,
+		APPROVED_AT DATE
+	)`, guardTable()))
+}
+
+// 超过阈值(数量或占本油田目标表记录数的百分比)时返回true 阈值为0时不检查
+func exceedsDeleteThreshold(deletes int, total int) bool {
+	gc := cfg.DeleteGuard
+	if gc.MaxDeletes > 0 && deletes > gc.MaxDeletes {
+		return true
+	}
+	if gc.MaxPercent > 0 && total > 0 && float64(deletes)*100/float64(total) > gc.MaxPercent {
+		return true
+	}
+	return false
+}
+
+// 检查本次待同步的D记录 超过阈值且未批准时返回false 本次不执行删除
+// 已批准且数量未超过批准时的数量则放行 批准仅对一次同步有效
+func checkDeleteGuard(ctx context.Context, rc config.RegionConfig, tasks []jobLog) bool {
+	if cfg.DeleteGuard.MaxDeletes <= 0 && cfg.DeleteGuard.MaxPercent <= 0 {
+		return true
+	}
+
+	region := rc.Name
+	deletes := 0
+	for _, t := range tasks {
+		if t.fl.DMLTYPE == "D" {
+			deletes++
+		}
+	}
+	if deletes == 0 {
+		return true
+	}
+
+	total, err := regionTargetTotal(ctx, rc, tasks)
+	if err != nil {
+		logger.Printf("%s checkDeleteGuard count error:%s\r\n", region, err.Error())
+		return false
+	}
+	if !exceedsDeleteThreshold(deletes, total) {
+		return true
+	}
+
+	hold, found, err := getDeleteHold(region)
+	if err != nil {
+		logger.Printf("%s checkDeleteGuard error:%s\r\n", region, err.Error())
+		return false
+	}
+	if found && hold.Status == "APPROVED" && deletes <= hold.Deletes {
+		logger.Printf("%s 批量删除已批准 执行%d条删除\r\n", region, deletes)
+		if _, err = targetDB.ExecContext(ctx, fmt.Sprintf(`DELETE FROM "%s" WHERE REGION = :1`, guardTable()), region); err != nil {
+			logger.Printf("%s checkDeleteGuard clear error:%s\r\n", region, err.Error())
+		}
+		return true
+	}
+
+	// 新的拦截或数量超过了批准时的数量 重新等待批准
+	sqlStr := fmt.Sprintf(`MERGE INTO "%s" g USING (SELECT :1 REGION FROM dual) s ON (g.REGION = s.REGION)
+		WHEN MATCHED THEN UPDATE SET PENDING_DELETES = :2, TARGET_TOTAL = :3, STATUS = 'PENDING', DETECTED_AT = SYSDATE, APPROVED_AT = NULL
+		WHEN NOT MATCHED THEN INSERT (REGION, PENDING_DELETES, TARGET_TOTAL, STATUS, DETECTED_AT) VALUES (:4, :5, :6, 'PENDING', SYSDATE)`, guardTable())
+	if _, err = targetDB.ExecContext(ctx, sqlStr, region, deletes, total, region, deletes, total); err != nil {
+		logger.Printf("%s checkDeleteGuard save error:%s\r\n", region, err.Error())
+	}
+
+	msg := fmt.Sprintf("%s 待删除%d条 本油田目标表共%d条 超过阈值 已暂停删除 批准: prospect_file_sync guard approve %s", region, deletes, total, region)
+	logger.Println(msg)
+	notifyDeleteHold(region, deletes, total, msg)
+	return false
+}
+
+// 本油田各同步表在目标表中的记录数之和 多个油田共用目标表时只统计本油田落盘目录下的记录
+// 否则其他油田的记录会稀释百分比 本油田清空重灌时也可能不被拦截
+func regionTargetTotal(ctx context.Context, rc config.RegionConfig, tasks []jobLog) (int, error) {
+	seen := map[string]bool{}
+	total := 0
+	for _, t := range tasks {
+		sqlStr, dirLike, err := regionCountSQL(rc, t.job)
+		if err != nil {
+			return 0, err
+		}
+		if seen[sqlStr+dirLike] {
+			continue
+		}
+		seen[sqlStr+dirLike] = true
+		count := 0
+		if err = targetDB.GetContext(ctx, &count, sqlStr, dirLike); err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// 同步表在本油田落盘目录下的目标库记录数 返回SQL和路径列的LIKE条件值
+func regionCountSQL(rc config.RegionConfig, job config.SyncJob) (string, string, error) {
+	dirLike, err := jobPathLike(rc, job)
+	if err != nil {
+		return "", "", err
+	}
+	return fmt.Sprintf(`SELECT COUNT(*) FROM "%s" WHERE %s LIKE :1 ESCAPE '\'`, job.TargetTable, job.PathColumn), dirLike, nil
+}
+
+// 拦截批量删除时 各同步表只同步第一条D之前的log 其后的log与D一起保留在源头库 批准后按原顺序处理
+// 跳过D继续同步时 批准后执行的D会删除其后已重新同步的同主键文件 检查点模式下还会使检查点越过被拦截的删除
+func beforeDeletes(tasks []jobLog) []jobLog {
+	held := map[string]bool{}
+	list := make([]jobLog, 0, len(tasks))
+	for _, t := range tasks {
+		if t.fl.DMLTYPE == "D" {
+			held[t.job.Name] = true
+		}
+		if !held[t.job.Name] {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+// 通知批量删除拦截 POST JSON到notifyUrl 未配置时仅记录日志
+func notifyDeleteHold(region string, deletes int, total int, msg string) {
+	if len(cfg.DeleteGuard.NotifyUrl) == 0 {
+		return
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"region":  region,
+		"deletes": deletes,
+		"total":   total,
+		"message": msg,
+	})
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(cfg.DeleteGuard.NotifyUrl, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Printf("%s notifyDeleteHold error:%s\r\n", region, err.Error())
+		return
+	}
+	resp.Body.Close()
+}
+
+func getDeleteHold(region string) (deleteHold, bool, error) {
+	var hold deleteHold
+	sqlStr := fmt.Sprintf(`SELECT REGION, PENDING_DELETES, TARGET_TOTAL, STATUS, DETECTED_AT, APPROVED_AT FROM "%s" WHERE REGION = :1`, guardTable())
+	err := targetDB.Get(&hold, sqlStr, region)
+	if errors.Is(err, sql.ErrNoRows) {
+		return deleteHold{}, false, nil
+	}
+	if err != nil {
+		return deleteHold{}, false, err
+	}
+	return hold, true, nil
+}
+
+// 查询全部批量删除拦截记录
+func listDeleteHolds() ([]deleteHold, error) {
+	list := []deleteHold{}
+	sqlStr := fmt.Sprintf(`SELECT REGION, PENDING_DELETES, TARGET_TOTAL, STATUS, DETECTED_AT, APPROVED_AT FROM "%s" ORDER BY DETECTED_AT DESC`, guardTable())
+	err := targetDB.Select(&list, sqlStr)
+	return list, err
+}
+
+// 批准油田的批量删除 下次同步时执行
+func approveDeletes(region string) error {
+	sqlStr := fmt.Sprintf(`UPDATE "%s" SET STATUS = 'APPROVED', APPROVED_AT = SYSDATE WHERE REGION = :1`, guardTable())
+	res, err := targetDB.Exec(sqlStr, strings.TrimSpace(region))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("region %s has no pending deletes", region)
+	}
+	logger.Printf("%s 批量删除已批准 下次同步时执行\r\n", region)
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"prospect_file_sync/config"
+)
+
+func Test_beforeDeletes(t *testing.T) {
+	a, b := config.SyncJob{Name: "a"}, config.SyncJob{Name: "b"}
+	tasks := []jobLog{
+		{job: a, fl: FileLog{SEQUENCE: "1", DMLTYPE: "I"}},
+		{job: b, fl: FileLog{SEQUENCE: "2", DMLTYPE: "D"}},
+		{job: a, fl: FileLog{SEQUENCE: "3", DMLTYPE: "D"}},
+		{job: a, fl: FileLog{SEQUENCE: "4", DMLTYPE: "U"}},
+		{job: b, fl: FileLog{SEQUENCE: "5", DMLTYPE: "I"}},
+	}
+	got := beforeDeletes(tasks)
+	if len(got) != 1 || got[0].fl.SEQUENCE != "1" {
+		t.Errorf("beforeDeletes() = %+v, want only SEQUENCE 1", got)
+	}
+}
+
+// 同主键先D后I 被拦截的D之后的I不能先执行 否则批准后的D会删除重新同步的文件
+func Test_beforeDeletes_sameKey(t *testing.T) {
+	job := config.SyncJob{Name: "a"}
+	keys := []KeyValue{{Column: "DW", Value: "dq"}, {Column: "JH", Value: "J1"}, {Column: "WDMC", Value: "a.pdf"}}
+	tasks := []jobLog{
+		{job: job, fl: FileLog{Keys: keys, SEQUENCE: "1", DMLTYPE: "D"}},
+		{job: job, fl: FileLog{Keys: keys, SEQUENCE: "2", DMLTYPE: "I"}},
+	}
+	if got := beforeDeletes(tasks); len(got) != 0 {
+		t.Errorf("beforeDeletes() = %+v, want none", got)
+	}
+}
+
+// 两个油田共用目标表 百分比只按本油田落盘目录下的记录计算
+func Test_regionCountSQL(t *testing.T) {
+	old := cfg.Target
+	defer func() { cfg.Target = old }()
+	cfg.Target.RootDir = "/data/files"
+	cfg.Target.FtpPrefix = "ftp://10.0.0.1/files"
+
+	job := config.SyncJob{Name: "a", TargetTable: "A", PathColumn: "CFLJ"}
+	dqSQL, dqLike, err := regionCountSQL(config.RegionConfig{Name: "dq"}, job)
+	if err != nil {
+		t.Fatalf("regionCountSQL() error = %v", err)
+	}
+	xjSQL, xjLike, _ := regionCountSQL(config.RegionConfig{Name: "xj"}, job)
+	if want := `SELECT COUNT(*) FROM "A" WHERE CFLJ LIKE :1 ESCAPE '\'`; dqSQL != want || xjSQL != want {
+		t.Errorf("regionCountSQL() = %s, want %s", dqSQL, want)
+	}
+	if want := `ftp://10.0.0.1/files/cnpc\_dq/%`; dqLike != want {
+		t.Errorf("regionCountSQL() dq like = %s, want %s", dqLike, want)
+	}
+	if want := `ftp://10.0.0.1/files/cnpc\_xj/%`; xjLike != want {
+		t.Errorf("regionCountSQL() xj like = %s, want %s", xjLike, want)
+	}
+
+	// dq清空重灌: 本油田100条全部删除 共用表中另有xj的900条
+	oldGuard := cfg.DeleteGuard
+	defer func() { cfg.DeleteGuard = oldGuard }()
+	cfg.DeleteGuard.MaxPercent = 10
+	if !exceedsDeleteThreshold(100, 100) {
+		t.Error("exceedsDeleteThreshold(100, 100) = false, want true")
+	}
+	if exceedsDeleteThreshold(100, 1000) {
+		t.Error("exceedsDeleteThreshold(100, 1000) = true, want false")
+	}
+}
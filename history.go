@@ -0,0 +1,180 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// 执行记录和失败记录保存到目标库 重启后恢复 管理页面的历史不丢失
+// 内存中的state为最近maxRuns/maxFailures条 表中只保留同样的条数
+
+const (
+	defaultRunTable     = "SYNC_RUN_HISTORY"
+	defaultFailureTable = "SYNC_FAILURE"
+)
+
+func runTable() string {
+	if len(cfg.Target.DB.RunTable) > 0 {
+		return cfg.Target.DB.RunTable
+	}
+	return defaultRunTable
+}
+
+func failureTable() string {
+	if len(cfg.Target.DB.FailureTable) > 0 {
+		return cfg.Target.DB.FailureTable
+	}
+	return defaultFailureTable
+}
+
+// 初始化目标库的执行记录表和失败记录表
+func ensureHistoryTables() error {
+	err := ensureTable(fmt.Sprintf(`CREATE TABLE "%s" (
+		ID NUMBER PRIMARY KEY,
+		REGION VARCHAR2(100),
+		STARTED_AT TIMESTAMP,
+		ENDED_AT TIMESTAMP,
+		TOTAL NUMBER,
+		SUCCEEDED NUMBER,
+		FAILED NUMBER,
+		ERROR_MSG CLOB
+	)`, runTable()))
+	if err != nil {
+		return err
+	}
+	return ensureTable(fmt.Sprintf(`CREATE TABLE "%s" (
+		ID NUMBER PRIMARY KEY,
+		REGION VARCHAR2(100),
+		JOB VARCHAR2(100),
+		LOG_DATA VARCHAR2(4000),
+		ERROR_MSG CLOB,
+		PERMANENT NUMBER(1),
+		FAILED_AT TIMESTAMP
+	)`, failureTable()))
+}
+
+type runRow struct {
+	ID        int64          `db:"ID"`
+	Region    string         `db:"REGION"`
+	StartedAt time.Time      `db:"STARTED_AT"`
+	EndedAt   time.Time      `db:"ENDED_AT"`
+	Total     int            `db:"TOTAL"`
+	Succeeded int            `db:"SUCCEEDED"`
+	Failed    int            `db:"FAILED"`
+	Error     sql.NullString `db:"ERROR_MSG"`
+}
+
+type failureRow struct {
+	ID        int            `db:"ID"`
+	Region    string         `db:"REGION"`
+	Job       sql.NullString `db:"JOB"`
+	LogData   string         `db:"LOG_DATA"`
+	Error     sql.NullString `db:"ERROR_MSG"`
+	Permanent int            `db:"PERMANENT"`
+	FailedAt  time.Time      `db:"FAILED_AT"`
+}
+
+// 启动时从目标库恢复最近的执行记录和失败记录
+func loadHistory() error {
+	runs := []runRow{}
+	sqlStr := fmt.Sprintf(`SELECT * FROM (SELECT ID, REGION, STARTED_AT, ENDED_AT, TOTAL, SUCCEEDED, FAILED, ERROR_MSG FROM "%s" ORDER BY ID DESC) WHERE ROWNUM <= :1`, runTable())
+	if err := targetDB.Select(&runs, sqlStr, maxRuns); err != nil {
+		return err
+	}
+	failures := []failureRow{}
+	sqlStr = fmt.Sprintf(`SELECT * FROM (SELECT ID, REGION, JOB, LOG_DATA, ERROR_MSG, PERMANENT, FAILED_AT FROM "%s" ORDER BY ID DESC) WHERE ROWNUM <= :1`, failureTable())
+	if err := targetDB.Select(&failures, sqlStr, maxFailures); err != nil {
+		return err
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.runs = state.runs[:0]
+	for i := len(runs) - 1; i >= 0; i-- {
+		r := runs[i]
+		state.runs = append(state.runs, RunRecord{
+			ID:        r.ID,
+			Region:    r.Region,
+			StartedAt: r.StartedAt,
+			EndedAt:   r.EndedAt,
+			Total:     r.Total,
+			Succeeded: r.Succeeded,
+			Failed:    r.Failed,
+			Error:     r.Error.String,
+		})
+	}
+	state.failures = state.failures[:0]
+	for i := len(failures) - 1; i >= 0; i-- {
+		f := failures[i]
+		var fl FileLog
+		if err := json.Unmarshal([]byte(f.LogData), &fl); err != nil {
+			logger.Printf("loadHistory failure %d error:%s\r\n", f.ID, err.Error())
+			continue
+		}
+		state.failures = append(state.failures, Failure{
+			ID:        f.ID,
+			Region:    f.Region,
+			Job:       f.Job.String,
+			Log:       fl,
+			Error:     f.Error.String,
+			Time:      f.FailedAt,
+			Permanent: f.Permanent == 1,
+		})
+		if f.ID > state.nextID {
+			state.nextID = f.ID
+		}
+	}
+	return nil
+}
+
+// 保存一条执行记录 删除超出保留条数的旧记录
+func saveRun(r RunRecord, oldest int64) {
+	if targetDB == nil {
+		return
+	}
+	sqlStr := fmt.Sprintf(`INSERT INTO "%s" (ID, REGION, STARTED_AT, ENDED_AT, TOTAL, SUCCEEDED, FAILED, ERROR_MSG)
+		VALUES (:1, :2, :3, :4, :5, :6, :7, :8)`, runTable())
+	_, err := targetDB.Exec(sqlStr, r.ID, r.Region, r.StartedAt, r.EndedAt, r.Total, r.Succeeded, r.Failed, r.Error)
+	if err != nil {
+		logger.Printf("%s saveRun error:%s\r\n", r.Region, err.Error())
+		return
+	}
+	if _, err = targetDB.Exec(fmt.Sprintf(`DELETE FROM "%s" WHERE ID < :1`, runTable()), oldest); err != nil {
+		logger.Printf("%s saveRun prune error:%s\r\n", r.Region, err.Error())
+	}
+}
+
+// 保存失败记录的变化 removed为被替换或已清除的记录ID oldest为保留的最旧记录ID 均为0时忽略
+func saveFailure(f *Failure, removed int, oldest int) {
+	if targetDB == nil {
+		return
+	}
+	if removed > 0 {
+		if _, err := targetDB.Exec(fmt.Sprintf(`DELETE FROM "%s" WHERE ID = :1`, failureTable()), removed); err != nil {
+			logger.Printf("deleteFailure error:%s\r\n", err.Error())
+		}
+	}
+	if f != nil {
+		data, err := json.Marshal(f.Log)
+		if err != nil {
+			logger.Printf("%s saveFailure error:%s\r\n", f.Region, err.Error())
+			return
+		}
+		permanent := 0
+		if f.Permanent {
+			permanent = 1
+		}
+		sqlStr := fmt.Sprintf(`INSERT INTO "%s" (ID, REGION, JOB, LOG_DATA, ERROR_MSG, PERMANENT, FAILED_AT)
+			VALUES (:1, :2, :3, :4, :5, :6, :7)`, failureTable())
+		if _, err = targetDB.Exec(sqlStr, f.ID, f.Region, f.Job, string(data), f.Error, permanent, f.Time); err != nil {
+			logger.Printf("%s saveFailure error:%s\r\n", f.Region, err.Error())
+		}
+	}
+	if oldest > 0 {
+		if _, err := targetDB.Exec(fmt.Sprintf(`DELETE FROM "%s" WHERE ID < :1`, failureTable()), oldest); err != nil {
+			logger.Printf("saveFailure prune error:%s\r\n", err.Error())
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"prospect_file_sync/config"
+)
+
+const (
+	hookPreStore   = "preStore"   // 文件已下载 写目标库记录之前 失败时删除已下载的文件
+	hookPostStore  = "postStore"  // 文件和目标库记录已写入
+	hookPostDelete = "postDelete" // 文件已移入回收站 目标库记录已删除
+)
+
+const defaultHookTimeout = time.Minute
+
+// 传给外部命令的文件信息 通过stdin以JSON传入
+type hookInput struct {
+	Event    string     `json:"event"`
+	Region   string     `json:"region"`
+	Job      string     `json:"job"`
+	Path     string     `json:"path"` // 落盘路径
+	DMLType  string     `json:"dmlType"`
+	Sequence string     `json:"sequence"`
+	Keys     []KeyValue `json:"keys"`
+	Row      FileRow    `json:"row"`
+}
+
+// 依次执行事件对应的外部命令 onError为fail的命令失败时返回错误 warn时仅记录日志
+func runHooks(ctx context.Context, event string, rc config.RegionConfig, job config.SyncJob, fl FileLog, row FileRow, storePath string) (err error) {
+	hooks := make([]config.HookConfig, 0)
+	for _, h := range cfg.Hooks {
+		if h.Event == event && len(h.Command) > 0 {
+			hooks = append(hooks, h)
+		}
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	ctx, span := startSpan(ctx, "hook."+event, rc.Name, &fl)
+	defer func() { endSpan(span, err) }()
+
+	in := hookInput{
+		Event:    event,
+		Region:   rc.Name,
+		Job:      job.Name,
+		Path:     storePath,
+		DMLType:  fl.DMLTYPE,
+		Sequence: fl.SEQUENCE,
+		Keys:     fl.Keys,
+		Row:      row,
+	}
+	stdin, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	env := append(os.Environ(),
+		"SYNC_EVENT="+event,
+		"SYNC_REGION="+rc.Name,
+		"SYNC_JOB="+job.Name,
+		"SYNC_FILE_PATH="+storePath,
+		"SYNC_DMLTYPE="+fl.DMLTYPE,
+		"SYNC_SEQUENCE="+fl.SEQUENCE,
+	)
+	for _, kv := range fl.Keys {
+		env = append(env, "SYNC_KEY_"+kv.Column+"="+kv.Value)
+	}
+
+	for _, h := range hooks {
+		herr := runHook(ctx, h, env, stdin)
+		if herr == nil {
+			continue
+		}
+		if h.OnError == "warn" {
+			logger.Printf("%s hook[%s] warn:%s\r\n", rc.Name, event, herr.Error())
+			continue
+		}
+		logger.Printf("%s hook[%s] error:%s\r\n", rc.Name, event, herr.Error())
+		return herr
+	}
+	return nil
+}
+
+func runHook(ctx context.Context, h config.HookConfig, env []string, stdin []byte) error {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Env = env
+	cmd.Stdin = bytes.NewReader(stdin)
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s timeout after %s", h.Command[0], timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s %s", h.Command[0], err.Error(), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
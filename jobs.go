@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"strings"
+
+	"prospect_file_sync/config"
+)
+
+const defaultPathColumn = "CFLJ"
+
+var defaultKeyColumns = []string{"DW", "JH", "WDMC"}
+
+// 油田配置的同步表 未配置jobs时由db.logTable/db.fileTable和target.db.fileTable组成一个
+func regionJobs(rc config.RegionConfig) []config.SyncJob {
+	jobs := rc.Jobs
+	if len(jobs) == 0 {
+		jobs = []config.SyncJob{{
+			Name:        rc.DB.FileTable,
+			LogTable:    rc.DB.LogTable,
+			FileTable:   rc.DB.FileTable,
+			TargetTable: cfg.Target.DB.FileTable,
+			Columns:     rc.Columns,
+		}}
+	}
+
+	list := make([]config.SyncJob, 0, len(jobs))
+	for _, job := range jobs {
+		job.PathColumn = strings.ToUpper(job.PathColumn)
+		if len(job.PathColumn) == 0 {
+			job.PathColumn = defaultPathColumn
+		}
+		if len(job.Name) == 0 {
+			job.Name = job.FileTable
+		}
+		if len(job.KeyColumns) == 0 {
+			job.KeyColumns = defaultKeyColumns
+		}
+		keys := make([]string, 0, len(job.KeyColumns))
+		for _, k := range job.KeyColumns {
+			keys = append(keys, strings.ToUpper(k))
+		}
+		job.KeyColumns = keys
+		list = append(list, job)
+	}
+	return list
+}
+
+// 按名称查找油田的同步表 name为空时返回第一个
+func findJob(rc config.RegionConfig, name string) (config.SyncJob, bool) {
+	jobs := regionJobs(rc)
+	if len(name) == 0 && len(jobs) > 0 {
+		return jobs[0], true
+	}
+	for _, job := range jobs {
+		if job.Name == name {
+			return job, true
+		}
+	}
+	return config.SyncJob{}, false
+}
+
+// 校验同步表配置
+func checkJob(job config.SyncJob) error {
+	if len(job.LogTable) == 0 && len(job.Timestamp.Column) == 0 {
+		return errors.New("logTable is null")
+	}
+	if len(job.FileTable) == 0 {
+		return errors.New("fileTable is null")
+	}
+	if len(job.TargetTable) == 0 {
+		return errors.New("targetTable is null")
+	}
+	return nil
+}
+
+// 同步表在油田落盘目录下的目标库记录 路径列的LIKE条件值 配合ESCAPE '\'
+func jobPathLike(rc config.RegionConfig, job config.SyncJob) (string, error) {
+	dir := getFileFTPPath(path.Join(cfg.Target.RootDir, regionPrefix+rc.Name, job.StoreDir))
+	if len(dir) == 0 {
+		return "", errors.New("无法确定油田落盘目录的ftp地址")
+	}
+	return escapeLike(strings.TrimSuffix(dir, "/")) + "/%", nil
+}
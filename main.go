@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/robfig/cron/v3"
 	"gopkg.in/natefinch/lumberjack.v2"
@@ -15,6 +22,9 @@ var wg sync.WaitGroup
 var cfg = config.Cfg
 var logger *log.Logger
 
+var runMu sync.Mutex      // 同一时刻只允许一个job执行
+var schedulerPaused int32 // 1: 暂停cron定时任务
+
 func main() {
 	// 1. init log
 	if cfg.Profile == "prod" {
@@ -28,20 +38,163 @@ func main() {
 		logger = log.New(os.Stdout, "", log.Lshortfile|log.Ldate|log.Ltime)
 	}
 
-	// 2. init 目标库连接
+	// 命令行子命令 执行后退出
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1:])
+		return
+	}
+
+	// 2. init 链路追踪
+	shutdownTracing := initTracing(cfg.Tracing)
+
+	// 3. init 目标库连接和落盘存储
 	InitTargetDB(cfg)
+	InitTargetStore(cfg)
 
-	// 3. 注册每日任务
+	// 4. 注册每日任务
 	registerDailyJob()
 
-	// 4. 即刻执行一次job
-	runJob()
+	// 5. 启动管理接口、内置FTP服务和推送接收端
+	startAdminServer(cfg.Admin)
+	startFtpServer(cfg.FtpServer, cfg.Target)
+	startReceiver(cfg.Receiver)
+
+	// 6. 即刻执行一次job
+	go runJob()
 
-	select {}
+	// 7. 收到SIGINT/SIGTERM时导出未发送的span后退出
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	logger.Println("收到退出信号 停止服务")
+	sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	shutdownTracing(sctx)
 }
 
+// 退出时导出span的最长等待时间
+const shutdownTimeout = 10 * time.Second
+
 func runJob() {
-	for _, rc := range cfg.Regions {
+	if !runMu.TryLock() {
+		logger.Println("已有job执行中 本次跳过")
+		return
+	}
+	defer runMu.Unlock()
+	runJobLocked()
+}
+
+// 同步全部油田后清理回收站 调用方已持有runMu
+func runJobLocked() {
+	syncRegions(cfg.Regions)
+	purgeTrash()
+}
+
+// 命令行子命令
+//
+//	agent               agent模式 在油田文件服务器上代替HFS提供文件下载
+//	push                推送模式 在油田读取MLOG$和源头表 推送到receiver
+//	export-bundle <油田> <离线包.tar>     在油田导出待同步的log和文件
+//	import-bundle <离线包.tar> <确认.json> 导入离线包 生成确认文件
+//	import-ack <确认.json>               在油田导入确认文件 删除已写入的log
+//	checkpoint list      列出checkpoint消费方式的检查点
+//	checkpoint reset <油田> <log表> <SEQUENCE$$> 重置检查点 从该处之后重新同步 0为从头
+//	trash list          列出回收站记录
+//	trash restore <id>  从回收站恢复文件和目标库记录
+//	version list <主键>  列出文档的历史版本 主键为各主键列值以-连接 如 DW-JH-WDMC
+//	version restore <id> 恢复历史版本
+//	guard list           列出批量删除拦截记录
+//	guard approve <油田>  批准油田的批量删除 下次同步时执行
+func runCommand(args []string) {
+	// agent/push/export-bundle/import-ack在油田执行 不连接目标库
+	switch {
+	case len(args) == 1 && args[0] == "agent":
+		runAgent(cfg.Agent)
+		return
+	case len(args) == 1 && args[0] == "push":
+		runPush(cfg.Push)
+		return
+	case len(args) == 3 && args[0] == "export-bundle":
+		if err := exportBundle(args[1], args[2]); err != nil {
+			logger.Fatalln("exportBundle error: " + err.Error())
+		}
+		return
+	case len(args) == 2 && args[0] == "import-ack":
+		if err := importAck(args[1]); err != nil {
+			logger.Fatalln("importAck error: " + err.Error())
+		}
+		return
+	}
+
+	InitTargetDB(cfg)
+	InitTargetStore(cfg)
+
+	switch {
+	case len(args) == 3 && args[0] == "import-bundle":
+		if err := importBundle(args[1], args[2]); err != nil {
+			logger.Fatalln("importBundle error: " + err.Error())
+		}
+	case len(args) == 2 && args[0] == "checkpoint" && args[1] == "list":
+		list, err := listCheckpoints()
+		if err != nil {
+			logger.Fatalln("listCheckpoints error: " + err.Error())
+		}
+		for _, c := range list {
+			fmt.Printf("%s\t%s\t%s\t%s\r\n", c.Region, c.LogTable, c.Sequence, c.UpdatedAt.Format("2006-01-02 15:04:05"))
+		}
+	case len(args) == 5 && args[0] == "checkpoint" && args[1] == "reset":
+		if err := resetCheckpoint(args[2], args[3], args[4]); err != nil {
+			logger.Fatalln("resetCheckpoint error: " + err.Error())
+		}
+	case len(args) == 2 && args[0] == "trash" && args[1] == "list":
+		list, err := listTrash()
+		if err != nil {
+			logger.Fatalln("listTrash error: " + err.Error())
+		}
+		for _, item := range list {
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\r\n", item.ID, item.DeletedAt.Format("2006-01-02 15:04:05"),
+				item.Region, item.Reason, item.Keys, item.OriginalPath)
+		}
+	case len(args) == 3 && args[0] == "trash" && args[1] == "restore":
+		if err := restoreTrash(args[2]); err != nil {
+			logger.Fatalln("restoreTrash error: " + err.Error())
+		}
+	case len(args) == 3 && args[0] == "version" && args[1] == "list":
+		list, err := listVersions("", "", args[2])
+		if err != nil {
+			logger.Fatalln("listVersions error: " + err.Error())
+		}
+		for _, v := range list {
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\r\n", v.ID, v.CreatedAt.Format("2006-01-02 15:04:05"),
+				v.Region, v.Job, v.Sequence, v.FileSize, v.SHA256, v.OriginalPath)
+		}
+	case len(args) == 3 && args[0] == "version" && args[1] == "restore":
+		if err := restoreVersion(args[2]); err != nil {
+			logger.Fatalln("restoreVersion error: " + err.Error())
+		}
+	case len(args) == 2 && args[0] == "guard" && args[1] == "list":
+		list, err := listDeleteHolds()
+		if err != nil {
+			logger.Fatalln("listDeleteHolds error: " + err.Error())
+		}
+		for _, h := range list {
+			fmt.Printf("%s\t%s\t%d/%d\t%s\r\n", h.Region, h.Status, h.Deletes, h.Total, h.DetectedAt.Format("2006-01-02 15:04:05"))
+		}
+	case len(args) == 3 && args[0] == "guard" && args[1] == "approve":
+		if err := approveDeletes(args[2]); err != nil {
+			logger.Fatalln("approveDeletes error: " + err.Error())
+		}
+	default:
+		logger.Fatalf("unknown command:%s usage: agent | push | export-bundle <region> <bundle.tar> | import-bundle <bundle.tar> <ack.json> | import-ack <ack.json> | checkpoint list | checkpoint reset <region> <logTable> <seq> | trash list | trash restore <id> | version list <key> | version restore <id> | guard list | guard approve <region>\r\n", strings.Join(args, " "))
+	}
+}
+
+// 依次同步指定的油田 调用方已持有runMu
+func syncRegions(regions []config.RegionConfig) {
+	for _, rc := range regions {
+		if rc.Push { // 推送模式的油田由agent推送 不拉取
+			continue
+		}
 		SyncFiles(rc)
 	}
 }
@@ -53,6 +206,10 @@ func registerDailyJob() {
 
 	c := newWithSeconds()
 	_, err := c.AddFunc(cfg.Cron, func() {
+		if atomic.LoadInt32(&schedulerPaused) == 1 {
+			logger.Println("定时任务已暂停 跳过job")
+			return
+		}
 		logger.Println("执行一次job")
 		runJob()
 	})
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"prospect_file_sync/util"
+)
+
+const defaultMetaTable = "SYNC_FILE_META"
+
+// 已落盘文件的源文件信息 用于条件下载
+type fileMeta struct {
+	StorePath    string `db:"STORE_PATH"`
+	ETag         string `db:"ETAG"`
+	LastModified string `db:"LAST_MODIFIED"`
+	Size         int64  `db:"FILE_SIZE"`
+	SHA256       string `db:"SHA256"`
+}
+
+func metaTable() string {
+	if len(cfg.Target.DB.MetaTable) > 0 {
+		return cfg.Target.DB.MetaTable
+	}
+	return defaultMetaTable
+}
+
+// 落盘路径统一为/分隔 兼容旧记录中\分隔的落盘路径
+// 落盘路径统一为/分隔 兼容旧记录中\\分隔的落盘路径
+func metaKey(storePath string) string {
+	return strings.ReplaceAll(storePath, "\\", "/")
+}
+
+// 建表 已存在时忽略(ORA-00955)
+func ensureTable(ddl string) error {
+	_, err := targetDB.Exec(ddl)
+	if err != nil && !strings.Contains(err.Error(), "ORA-00955") {
+		return err
+	}
+	return nil
+}
+
+// 初始化目标库的文件信息表
+func ensureMetaTable() error {
+	return ensureTable(fmt.Sprintf(`CREATE TABLE "%s" (
+		STORE_PATH VARCHAR2(1000) PRIMARY KEY,
+		ETAG VARCHAR2(200),
+		LAST_MODIFIED VARCHAR2(100),
+		FILE_SIZE NUMBER,
+		SHA256 VARCHAR2(64),
+		UPDATED_AT DATE
+	)`, metaTable()))
+}
+
+// 查询已落盘文件的源文件信息
+func loadFileMeta(ctx context.Context, storePath string) (fileMeta, bool, error) {
+	var m fileMeta
+	sqlStr := fmt.Sprintf(`SELECT STORE_PATH, NVL(ETAG, ' ') ETAG, NVL(LAST_MODIFIED, ' ') LAST_MODIFIED, NVL(FILE_SIZE, -1) FILE_SIZE, NVL(SHA256, ' ') SHA256 FROM "%s" WHERE STORE_PATH = :1`, metaTable())
+	err := targetDB.GetContext(ctx, &m, sqlStr, metaKey(storePath))
+	if errors.Is(err, sql.ErrNoRows) {
+		return fileMeta{}, false, nil
+	}
+	if err != nil {
+		return fileMeta{}, false, err
+	}
+
+	m.ETag = strings.TrimSpace(m.ETag)
+	m.LastModified = strings.TrimSpace(m.LastModified)
+	m.SHA256 = strings.TrimSpace(m.SHA256)
+	return m, true, nil
+}
+
+// 保存文件下载结果
+func saveFileMeta(ctx context.Context, storePath string, r util.DownloadResult) error {
+	sqlStr := fmt.Sprintf(`MERGE INTO "%s" m USING (SELECT :1 STORE_PATH FROM dual) s ON (m.STORE_PATH = s.STORE_PATH)
+		WHEN MATCHED THEN UPDATE SET ETAG = :2, LAST_MODIFIED = :3, FILE_SIZE = :4, SHA256 = :5, UPDATED_AT = SYSDATE
+		WHEN NOT MATCHED THEN INSERT (STORE_PATH, ETAG, LAST_MODIFIED, FILE_SIZE, SHA256, UPDATED_AT) VALUES (:6, :7, :8, :9, :10, SYSDATE)`, metaTable())
+	key := metaKey(storePath)
+	_, err := targetDB.ExecContext(ctx, sqlStr, key, r.ETag, r.LastModified, r.Size, r.SHA256,
+		key, r.ETag, r.LastModified, r.Size, r.SHA256)
+	return err
+}
+
+// 删除文件信息
+func deleteFileMeta(ctx context.Context, storePath string) error {
+	_, err := targetDB.ExecContext(ctx, fmt.Sprintf(`DELETE FROM "%s" WHERE STORE_PATH = :1`, metaTable()), metaKey(storePath))
+	return err
+}
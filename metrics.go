@@ -0,0 +1,39 @@
+package main
+
+import (
+	"expvar"
+	"time"
+
+	"prospect_file_sync/config"
+	"prospect_file_sync/util"
+)
+
+// 运行指标 通过admin接口 /api/metrics 以expvar格式输出
+var (
+	metricDownloadBytes = expvar.NewInt("download_bytes_total")
+	metricDownloads     = expvar.NewInt("downloads_total")
+	metricDownloadRate  = expvar.NewFloat("download_rate_bytes")
+)
+
+// 返回下载进度回调 输出到日志、指标和job进度
+func downloadProgress(rc config.RegionConfig) util.ProgressFunc {
+	var last int64
+	return func(p util.Progress) {
+		metricDownloadBytes.Add(p.Bytes - last)
+		last = p.Bytes
+		metricDownloadRate.Set(p.Rate)
+		if p.Done {
+			metricDownloads.Add(1)
+		}
+		state.setDownload(p)
+
+		if p.Total > 0 {
+			logger.Printf("%s download %s %s/%s(%.1f%%) %s/s eta %s\r\n", rc.Name, p.Name,
+				util.FormatBytes(p.Bytes), util.FormatBytes(p.Total), p.Percent,
+				util.FormatBytes(int64(p.Rate)), p.ETA.Round(time.Second))
+		} else {
+			logger.Printf("%s download %s %s %s/s\r\n", rc.Name, p.Name,
+				util.FormatBytes(p.Bytes), util.FormatBytes(int64(p.Rate)))
+		}
+	}
+}
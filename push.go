@@ -0,0 +1,655 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"prospect_file_sync/config"
+	"prospect_file_sync/database"
+)
+
+// 推送模式: 油田网络只允许出站连接时 由油田上的agent(prospect_file_sync push)读取本地MLOG$和源头表
+// 文件分块上传到receiver 再提交log和文件详情 receiver按addFile/updateFile/deleteFile写入目标库和落盘
+// agent与receiver配置相同的油田名称和jobs receiver上该油田配置push: true
+
+// 分块上传的偏移量 HEAD返回已上传大小 PATCH时为本块的起始位置
+const headerUploadOffset = "Upload-Offset"
+
+var errPushRegion = errors.New("推送模式的油田由agent推送 不能在此同步")
+
+// receiver上正在执行同步或重新同步 agent停止本次推送 下次再推送
+var errReceiverBusy = errors.New("receiver正在执行同步 稍后再推送")
+
+// 本次推送被批量删除拦截 D保留在油田MLOG$中
+var errPushDeleteHeld = errors.New("批量删除已拦截 等待批准")
+
+// agent推送的一条log
+type pushRequest struct {
+	Region string    `json:"region"`
+	Job    string    `json:"job"`
+	Log    FileLog   `json:"log"`
+	Row    string    `json:"row,omitempty"`  // 源头库文件详情 encodeRow的结果 D时为空
+	File   *pushFile `json:"file,omitempty"` // 已上传的文件 D时为空
+}
+
+type pushFile struct {
+	ID      string    `json:"id"`
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// receiver写入的结果 Permanent为永久失败 agent删除log不再推送
+type pushResult struct {
+	Error     string `json:"error,omitempty"`
+	Permanent bool   `json:"permanent,omitempty"`
+}
+
+// 推送前提交的本次全部log 用于批量删除拦截 Entries只有Job和Log
+type pushPlan struct {
+	Region  string        `json:"region"`
+	Entries []pushRequest `json:"entries"`
+}
+
+type pushPlanResult struct {
+	AllowDeletes bool `json:"allowDeletes"`
+}
+
+// 上传文件的ID 由CFLJ生成
+func pushFileID(cflj string) string {
+	sum := sha256.Sum256([]byte(cflj))
+	return hex.EncodeToString(sum[:])
+}
+
+// receiver暂存上传文件的路径 作为推送模式油田的下载地址
+func pushFilePath(region string, cflj string) string {
+	return path.Join(cfg.Receiver.Dir, region, pushFileID(cflj))
+}
+
+func sha256File(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s := sha256.New()
+	if _, err = io.Copy(s, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(s.Sum(nil)), nil
+}
+
+// 推送模式的源头库 文件详情由agent随log推送 log由agent在receiver写入后删除
+type pushOrigin struct {
+	row FileRow
+}
+
+func (o pushOrigin) queryFile(ctx context.Context, job config.SyncJob, cols []config.ColumnMapping, fl FileLog) (FileRow, error) {
+	if o.row == nil {
+		return nil, errors.New("推送记录无源头库文件详情")
+	}
+	return o.row, nil
+}
+
+func (o pushOrigin) deleteLog(ctx context.Context, job config.SyncJob, fl FileLog) error {
+	return nil
+}
+
+// 启动推送接收端 addr为空时不启动
+func startReceiver(rc config.ReceiverConfig) {
+	if len(rc.Addr) == 0 {
+		return
+	}
+	if len(rc.Token) == 0 {
+		panic("receiver.token为空! 推送接收端必须配置访问令牌")
+	}
+
+	go func() {
+		logger.Printf("receiver listen on %s\r\n", rc.Addr)
+		var err error
+		if len(rc.CertFile) > 0 {
+			err = http.ListenAndServeTLS(rc.Addr, rc.CertFile, rc.KeyFile, newReceiverHandler(rc.Token))
+		} else {
+			err = http.ListenAndServe(rc.Addr, newReceiverHandler(rc.Token))
+		}
+		if err != nil {
+			logger.Printf("receiver error:%s\r\n", err.Error())
+		}
+	}()
+}
+
+func newReceiverHandler(token string) http.Handler {
+	api := http.NewServeMux()
+	api.HandleFunc("/push/plan", handlePushPlan)
+	api.HandleFunc("/push/files", handlePushUpload)
+	api.HandleFunc("/push/apply", handlePushApply)
+
+	mux := http.NewServeMux()
+	mux.Handle("/push/", requireToken(token, api))
+	return mux
+}
+
+// 分块上传 ?region=xx&id=xx
+// HEAD 返回已上传的大小 PATCH 从Upload-Offset处追加本块 Upload-Offset为0时重新上传
+func handlePushUpload(w http.ResponseWriter, r *http.Request) {
+	p, ok := pushUploadPath(r.URL.Query().Get("region"), r.URL.Query().Get("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "region or id not found")
+		return
+	}
+	part := p + ".part"
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set(headerUploadOffset, strconv.FormatInt(partSize(part), 10))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		offset, err := strconv.ParseInt(r.Header.Get(headerUploadOffset), 10, 64)
+		if err != nil || offset < 0 {
+			writeError(w, http.StatusBadRequest, "invalid "+headerUploadOffset)
+			return
+		}
+		if cur := partSize(part); offset != 0 && offset != cur {
+			w.Header().Set(headerUploadOffset, strconv.FormatInt(cur, 10))
+			writeError(w, http.StatusConflict, "offset mismatch")
+			return
+		}
+
+		flag := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		if offset == 0 {
+			flag |= os.O_TRUNC
+		}
+		if err = os.MkdirAll(path.Dir(part), 0755); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		f, err := os.OpenFile(part, flag, 0644)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		n, err := io.Copy(f, r.Body)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		// 中断时已写入的部分保留 agent按HEAD返回的大小续传
+		w.Header().Set(headerUploadOffset, strconv.FormatInt(offset+n, 10))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// 上传文件路径 油田须为推送模式 id为pushFileID的结果
+func pushUploadPath(region string, id string) (string, bool) {
+	rc, ok := findRegion(region)
+	if !ok || !rc.Push {
+		return "", false
+	}
+	if _, err := hex.DecodeString(id); err != nil || len(id) != sha256.Size*2 {
+		return "", false
+	}
+	return path.Join(cfg.Receiver.Dir, rc.Name, id), true
+}
+
+func partSize(part string) int64 {
+	fi, err := os.Stat(part)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+var pushDeletes sync.Map // 油田名称 -> 最近一次推送计划是否允许删除
+
+// POST 推送计划 与拉取时相同按本次全部log检查批量删除拦截 不允许时agent只推送各同步表第一条D之前的log
+func handlePushPlan(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var plan pushPlan
+	if err := json.NewDecoder(r.Body).Decode(&plan); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rc, ok := findRegion(plan.Region)
+	if !ok || !rc.Push {
+		writeError(w, http.StatusNotFound, "region not found")
+		return
+	}
+
+	allow := checkDeleteGuard(r.Context(), rc, planTasks(rc, plan.Entries))
+	pushDeletes.Store(rc.Name, allow)
+	writeJSON(w, http.StatusOK, pushPlanResult{AllowDeletes: allow})
+}
+
+// 未提交推送计划或计划被拦截时不执行D
+func pushDeletesAllowed(region string) bool {
+	v, ok := pushDeletes.Load(region)
+	return ok && v.(bool)
+}
+
+// 推送或离线包的log转为待同步列表 忽略未配置的同步表
+func planTasks(rc config.RegionConfig, entries []pushRequest) []jobLog {
+	tasks := make([]jobLog, 0, len(entries))
+	for _, e := range entries {
+		if job, ok := findJob(rc, e.Job); ok {
+			tasks = append(tasks, jobLog{job: job, fl: e.Log})
+		}
+	}
+	return tasks
+}
+
+// POST 写入一条推送的log 返回pushResult
+func handlePushApply(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var req pushRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rc, ok := findRegion(req.Region)
+	if !ok || !rc.Push {
+		writeError(w, http.StatusNotFound, "region not found")
+		return
+	}
+	job, ok := findJob(rc, req.Job)
+	if !ok {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+
+	if req.Log.DMLTYPE == "D" && !pushDeletesAllowed(rc.Name) {
+		writeJSON(w, http.StatusUnprocessableEntity, pushResult{Error: errPushDeleteHeld.Error()})
+		return
+	}
+
+	// agent断开时仍写完 避免目标库和落盘只执行了一半
+	err := applyPush(context.Background(), rc, job, req)
+	if errors.Is(err, errReceiverBusy) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, pushResult{Error: err.Error(), Permanent: isPermanentError(err)})
+		return
+	}
+	writeJSON(w, http.StatusOK, pushResult{})
+}
+
+// 按DMLTYPE写入推送的log 与本地同步、重新同步互斥
+func applyPush(ctx context.Context, rc config.RegionConfig, job config.SyncJob, req pushRequest) error {
+	if !runMu.TryLock() {
+		return errReceiverBusy
+	}
+	defer runMu.Unlock()
+	return applyPushLocked(ctx, rc, job, req)
+}
+
+// 按DMLTYPE写入推送的log 与拉取时相同 调用方已持有runMu
+func applyPushLocked(ctx context.Context, rc config.RegionConfig, job config.SyncJob, req pushRequest) error {
+	origin := pushOrigin{}
+	if len(req.Row) > 0 {
+		row, err := decodeRow(req.Row)
+		if err != nil {
+			return err
+		}
+		origin.row = row
+	}
+
+	if req.File != nil {
+		if origin.row == nil || req.File.ID != pushFileID(origin.row.Str(job.PathColumn)) {
+			return errors.New("上传文件与文件详情的CFLJ不一致")
+		}
+		p := path.Join(cfg.Receiver.Dir, rc.Name, req.File.ID)
+		if err := commitUpload(p, *req.File); err != nil {
+			return err
+		}
+		defer os.Remove(p)
+	}
+
+	return syncLog(ctx, origin, rc, job, req.Log)
+}
+
+// 校验上传完成的文件大小和sha256 改名为正式文件 修改时间与油田一致以便识别未变化的文件
+func commitUpload(p string, f pushFile) error {
+	part := p + ".part"
+	if f.Size == 0 {
+		if err := os.MkdirAll(path.Dir(part), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(part, nil, 0644); err != nil {
+			return err
+		}
+	}
+	if size := partSize(part); size != f.Size {
+		// 大小不一致的部分无法续传 删除后重新上传
+		os.Remove(part)
+		return fmt.Errorf("文件上传不完整 %d/%d", size, f.Size)
+	}
+	sum, err := sha256File(part)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(sum, f.SHA256) {
+		os.Remove(part)
+		return fmt.Errorf("上传文件sha256不一致 %s/%s", sum, f.SHA256)
+	}
+	if err = os.Rename(part, p); err != nil {
+		return err
+	}
+	return os.Chtimes(p, f.ModTime, f.ModTime)
+}
+
+// 推送模式 按cron定时把本机油田的log推送到receiver cron为空时执行一次后退出
+func runPush(pc config.PushConfig) {
+	if len(pc.Url) == 0 || len(pc.Token) == 0 {
+		logger.Fatalln("push error: push.url和push.token不能为空")
+	}
+	client, err := tokenClient(pc.Token, pc.CAFile, pc.InsecureSkipVerify)
+	if err != nil {
+		logger.Fatalln("push error: " + err.Error())
+	}
+	p := &pusher{url: strings.TrimSuffix(pc.Url, "/"), client: client, chunkSize: pc.ChunkSize}
+	if p.chunkSize <= 0 {
+		p.chunkSize = 4 << 20
+	}
+
+	run := func() {
+		if !runMu.TryLock() {
+			logger.Println("已有推送执行中 本次跳过")
+			return
+		}
+		defer runMu.Unlock()
+		for _, rc := range cfg.Regions {
+			p.pushRegion(rc)
+		}
+	}
+
+	if len(cfg.Cron) == 0 {
+		run()
+		return
+	}
+	c := newWithSeconds()
+	if _, err = c.AddFunc(cfg.Cron, run); err != nil {
+		logger.Fatalln("push cron error: " + err.Error())
+	}
+	c.Start()
+	run()
+	select {}
+}
+
+type pusher struct {
+	url       string
+	client    *http.Client
+	chunkSize int64
+}
+
+// 推送油田各同步表的全部log
+func (p *pusher) pushRegion(rc config.RegionConfig) {
+	logger.Printf("------------------ %s push start ------------------\r\n", rc.Name)
+	defer logger.Printf("------------------ %s push end ------------------\r\n", rc.Name)
+
+	if isCheckpoint(rc) {
+		logger.Printf("%s push error:推送模式不支持consume: checkpoint\r\n", rc.Name)
+		return
+	}
+	ctx := context.Background()
+	originDB, err := database.ConnectDB(rc.DB)
+	if err != nil {
+		logger.Printf("%s originDB init error: %s\r\n", rc.Name, err.Error())
+		return
+	}
+	defer originDB.Close()
+
+	tasks := make([]jobLog, 0)
+	for _, job := range regionJobs(rc) {
+		fls, err := loadFileLogs(ctx, originDB, rc, job)
+		if err != nil {
+			logger.Printf("%s[%s] queryFileLogsToSync error:%s\r\n", rc.Name, job.Name, err.Error())
+			continue
+		}
+
+		logger.Printf("%s[%s] %d logs to push\r\n", rc.Name, job.Name, len(fls))
+		for _, fl := range fls {
+			tasks = append(tasks, jobLog{job: job, fl: fl})
+		}
+	}
+
+	// receiver检查批量删除拦截 被拦截时各同步表只推送第一条D之前的log
+	allow, err := p.plan(ctx, rc.Name, tasks)
+	if err != nil {
+		logger.Printf("%s push plan error:%s\r\n", rc.Name, err.Error())
+		return
+	}
+	if !allow {
+		logger.Printf("%s 批量删除已被receiver拦截 本次不推送D及其后的log\r\n", rc.Name)
+		tasks = beforeDeletes(tasks)
+	}
+
+	for _, t := range tasks {
+		err = p.pushLog(ctx, originDB, rc, t.job, t.fl)
+		if errors.Is(err, errReceiverBusy) {
+			logger.Printf("%s push stopped:%s\r\n", rc.Name, err.Error())
+			return
+		}
+		if err != nil {
+			logger.Printf("%s[%s] %s pushLog error:%s\r\n", rc.Name, t.job.Name, t.fl.KeyString(), err.Error())
+		}
+	}
+}
+
+// 推送一条log I/U时先上传文件 receiver写入后删除log
+func (p *pusher) pushLog(ctx context.Context, originDB *sqlx.DB, rc config.RegionConfig, job config.SyncJob, fl FileLog) error {
+	req, local, err := newPushRequest(ctx, originDB, rc, job, fl)
+	if err != nil {
+		return err
+	}
+	if req.File != nil {
+		if err = p.upload(ctx, rc.Name, local, *req.File); err != nil {
+			return err
+		}
+	}
+
+	result, err := p.apply(ctx, req)
+	if err != nil {
+		return err
+	}
+	if len(result.Error) > 0 && !result.Permanent {
+		return errors.New(result.Error)
+	}
+	if result.Permanent {
+		logger.Printf("%s[%s] %s 永久失败:%s\r\n", rc.Name, job.Name, fl.KeyString(), result.Error)
+	}
+	return deleteLogRecord(ctx, originDB, fl, job.LogTable)
+}
+
+// 由log和源头库文件详情组成推送记录 I/U时带文件信息 返回文件的本地路径
+func newPushRequest(ctx context.Context, originDB *sqlx.DB, rc config.RegionConfig, job config.SyncJob, fl FileLog) (pushRequest, string, error) {
+	req := pushRequest{Region: rc.Name, Job: job.Name, Log: fl}
+	if fl.DMLTYPE == "D" {
+		return req, "", nil
+	}
+
+	ft, err := queryOriginFile(ctx, originDB, job.FileTable, jobColumns(job), fl)
+	if err != nil {
+		return req, "", err
+	}
+	if req.Row, err = encodeRow(ft); err != nil {
+		return req, "", err
+	}
+
+	cflj := ft.Str(job.PathColumn)
+	local := cflj
+	m, ok, err := mountPath(cflj, rc.Mounts)
+	if err != nil {
+		return req, "", err
+	}
+	if ok {
+		local = m
+	}
+	fi, err := os.Stat(local)
+	if err != nil {
+		return req, "", err
+	}
+	sum, err := sha256File(local)
+	if err != nil {
+		return req, "", err
+	}
+	req.File = &pushFile{ID: pushFileID(cflj), Size: fi.Size(), SHA256: sum, ModTime: fi.ModTime()}
+	return req, local, nil
+}
+
+// 分块上传文件 从receiver已有的大小处续传
+func (p *pusher) upload(ctx context.Context, region string, local string, pf pushFile) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	offset, err := p.uploadOffset(ctx, region, pf.ID)
+	if err != nil {
+		return err
+	}
+	if offset > pf.Size { // 源文件变小后重新推送 receiver上的部分比文件大 从头上传
+		offset = 0
+	}
+	for offset < pf.Size {
+		n := pf.Size - offset
+		if n > p.chunkSize {
+			n = p.chunkSize
+		}
+		next, err := p.uploadChunk(ctx, region, pf.ID, io.NewSectionReader(f, offset, n), offset, n)
+		if err != nil {
+			return err
+		}
+		offset = next
+		if offset > pf.Size { // receiver上是其他版本的文件 重新上传
+			offset = 0
+		}
+	}
+	return nil
+}
+
+func (p *pusher) filesUrl(region string, id string) string {
+	return p.url + "/push/files?region=" + url.QueryEscape(region) + "&id=" + id
+}
+
+func (p *pusher) uploadOffset(ctx context.Context, region string, id string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, p.filesUrl(region, id), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("receiver status %d", resp.StatusCode)
+	}
+	return strconv.ParseInt(resp.Header.Get(headerUploadOffset), 10, 64)
+}
+
+// 上传一块 返回receiver上的大小 偏移不一致时返回receiver的大小以便从该处继续
+func (p *pusher) uploadChunk(ctx context.Context, region string, id string, body io.Reader, offset int64, n int64) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, p.filesUrl(region, id), body)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = n
+	req.Header.Set(headerUploadOffset, strconv.FormatInt(offset, 10))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusConflict {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return 0, fmt.Errorf("receiver status %d: %s", resp.StatusCode, data)
+	}
+	return strconv.ParseInt(resp.Header.Get(headerUploadOffset), 10, 64)
+}
+
+// 提交推送计划 返回receiver是否允许本次删除
+func (p *pusher) plan(ctx context.Context, region string, tasks []jobLog) (bool, error) {
+	plan := pushPlan{Region: region, Entries: make([]pushRequest, 0, len(tasks))}
+	for _, t := range tasks {
+		plan.Entries = append(plan.Entries, pushRequest{Region: region, Job: t.job.Name, Log: t.fl})
+	}
+	body, err := json.Marshal(plan)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url+"/push/plan", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("receiver status %d: %s", resp.StatusCode, data)
+	}
+	var result pushPlanResult
+	err = json.Unmarshal(data, &result)
+	return result.AllowDeletes, err
+}
+
+func (p *pusher) apply(ctx context.Context, pr pushRequest) (pushResult, error) {
+	body, err := json.Marshal(pr)
+	if err != nil {
+		return pushResult{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url+"/push/apply", bytes.NewReader(body))
+	if err != nil {
+		return pushResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return pushResult{}, err
+	}
+	defer resp.Body.Close()
+
+	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusConflict {
+		return pushResult{}, errReceiverBusy
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnprocessableEntity {
+		return pushResult{}, fmt.Errorf("receiver status %d: %s", resp.StatusCode, data)
+	}
+	var result pushResult
+	err = json.Unmarshal(data, &result)
+	return result, err
+}
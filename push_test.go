@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"prospect_file_sync/config"
+)
+
+func TestPushUpload(t *testing.T) {
+	oldDir, oldRegions := cfg.Receiver.Dir, cfg.Regions
+	defer func() { cfg.Receiver.Dir, cfg.Regions = oldDir, oldRegions }()
+	cfg.Receiver.Dir = filepath.ToSlash(t.TempDir())
+	cfg.Regions = []config.RegionConfig{{Name: "dq", Push: true}, {Name: "xj"}}
+
+	srv := httptest.NewServer(newReceiverHandler("t"))
+	defer srv.Close()
+	client, _ := tokenClient("t", "", false)
+	p := &pusher{url: srv.URL, client: client, chunkSize: 4}
+
+	local := filepath.Join(t.TempDir(), "a.pdf")
+	os.WriteFile(local, []byte("%PDF-1.4 0123456789"), 0644)
+	cflj := `D:\KTXXWD\well\a.pdf`
+	id := pushFileID(cflj)
+
+	// 上次中断时已上传的部分 从该处续传
+	dst := pushFilePath("dq", cflj)
+	os.MkdirAll(filepath.Dir(dst), 0755)
+	os.WriteFile(dst+".part", []byte("%PDF-1"), 0644)
+
+	sum, _ := sha256File(local)
+	fi, _ := os.Stat(local)
+	pf := pushFile{ID: id, Size: fi.Size(), SHA256: sum, ModTime: fi.ModTime()}
+	err := p.upload(context.Background(), "dq", local, pf)
+	if err != nil {
+		t.Fatalf("upload() error = %v", err)
+	}
+	if data, _ := os.ReadFile(dst + ".part"); string(data) != "%PDF-1.4 0123456789" {
+		t.Fatalf("upload() got %q", data)
+	}
+
+	if err = commitUpload(dst, pf); err != nil {
+		t.Fatalf("commitUpload() error = %v", err)
+	}
+	if fi, err := os.Stat(dst); err != nil || !fi.ModTime().Equal(pf.ModTime) {
+		t.Errorf("commitUpload() stat = %v, %v", fi, err)
+	}
+
+	// sha256不一致时删除已上传的部分
+	os.WriteFile(dst+".part", []byte("%PDF-1.4 9876543210"), 0644)
+	if err = commitUpload(dst, pf); err == nil {
+		t.Errorf("commitUpload() sha256 mismatch error = nil")
+	}
+	if _, err = os.Stat(dst + ".part"); !os.IsNotExist(err) {
+		t.Errorf("commitUpload() part not removed")
+	}
+
+	// receiver上的部分比文件大(源文件变小后重新推送) 从头上传
+	os.WriteFile(dst+".part", []byte("%PDF-1.4 0123456789 older and longer"), 0644)
+	if err = p.upload(context.Background(), "dq", local, pf); err != nil {
+		t.Fatalf("upload() oversized part error = %v", err)
+	}
+	if err = commitUpload(dst, pf); err != nil {
+		t.Errorf("commitUpload() after oversized part error = %v", err)
+	}
+
+	// 大小不一致时删除已上传的部分
+	os.WriteFile(dst+".part", []byte("%PDF-1.4"), 0644)
+	if err = commitUpload(dst, pf); err == nil {
+		t.Errorf("commitUpload() size mismatch error = nil")
+	}
+	if _, err = os.Stat(dst + ".part"); !os.IsNotExist(err) {
+		t.Errorf("commitUpload() size mismatch part not removed")
+	}
+
+	// 非推送模式的油田和无令牌的请求
+	if err = p.upload(context.Background(), "xj", local, pf); err == nil {
+		t.Errorf("upload() pull region error = nil")
+	}
+	resp, _ := http.Head(srv.URL + "/push/files?region=dq&id=" + id)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("no token status = %d", resp.StatusCode)
+	}
+}
+
+func TestPushApply_guard(t *testing.T) {
+	oldRegions := cfg.Regions
+	defer func() { cfg.Regions = oldRegions }()
+	cfg.Regions = []config.RegionConfig{{Name: "dq", Push: true, DB: config.DB{LogTable: "MLOG$_A", FileTable: "A"}}}
+	pushDeletes.Delete("dq")
+
+	srv := httptest.NewServer(newReceiverHandler("t"))
+	defer srv.Close()
+	client, _ := tokenClient("t", "", false)
+	p := &pusher{url: srv.URL, client: client, chunkSize: 4}
+
+	// 未提交推送计划时不执行D
+	del := pushRequest{Region: "dq", Job: "A", Log: FileLog{SEQUENCE: "1", DMLTYPE: "D"}}
+	result, err := p.apply(context.Background(), del)
+	if err != nil || result.Error != errPushDeleteHeld.Error() || result.Permanent {
+		t.Errorf("apply() D without plan = %+v, %v", result, err)
+	}
+
+	// 本地同步执行中
+	runMu.Lock()
+	defer runMu.Unlock()
+	upd := pushRequest{Region: "dq", Job: "A", Log: FileLog{SEQUENCE: "2", DMLTYPE: "U"}}
+	if _, err = p.apply(context.Background(), upd); err != errReceiverBusy {
+		t.Errorf("apply() while running error = %v, want errReceiverBusy", err)
+	}
+}
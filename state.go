@@ -0,0 +1,220 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"prospect_file_sync/util"
+)
+
+// 保留的最近失败记录条数
+const maxFailures = 500
+
+// 保留的最近执行记录条数
+const maxRuns = 200
+
+// 当前执行中job的进度
+type JobProgress struct {
+	Running   bool      `json:"running"`
+	Region    string    `json:"region"`
+	Total     int       `json:"total"`
+	Done      int       `json:"done"`
+	Failed    int       `json:"failed"`
+	Current   string    `json:"current"`
+	StartedAt time.Time `json:"startedAt"`
+
+	Download *util.Progress `json:"download,omitempty"` // 当前文件下载进度
+}
+
+// 同步失败的log记录 可通过admin接口重新入队
+type Failure struct {
+	ID     int       `json:"id"`
+	Region string    `json:"region"`
+	Job    string    `json:"job"`
+	Log    FileLog   `json:"log"`
+	Error  string    `json:"error"`
+	Time   time.Time `json:"time"`
+
+	Permanent bool `json:"permanent"` // 内容校验失败 log已删除 不会自动重试
+}
+
+// 单个油田一次同步的执行记录
+type RunRecord struct {
+	ID        int64     `json:"id"`
+	Region    string    `json:"region"`
+	StartedAt time.Time `json:"startedAt"`
+	EndedAt   time.Time `json:"endedAt"`
+	Total     int       `json:"total"`
+	Succeeded int       `json:"succeeded"`
+	Failed    int       `json:"failed"`
+	Error     string    `json:"error,omitempty"` // 整体失败原因 如源头库连接失败
+}
+
+type syncState struct {
+	mu       sync.Mutex
+	progress JobProgress
+	failures []Failure
+	nextID   int
+	runs     []RunRecord
+}
+
+var state = &syncState{}
+
+func (s *syncState) startRegion(region string, total int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.progress = JobProgress{
+		Running:   true,
+		Region:    region,
+		Total:     total,
+		StartedAt: time.Now(),
+	}
+}
+
+func (s *syncState) setCurrent(job string, fl FileLog) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.progress.Current = job + " " + fl.SEQUENCE + "[" + fl.DMLTYPE + "] " + fl.KeyString()
+}
+
+func (s *syncState) itemDone(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.progress.Done++
+	if err != nil {
+		s.progress.Failed++
+	}
+	s.progress.Current = ""
+	s.progress.Download = nil
+}
+
+func (s *syncState) setDownload(p util.Progress) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.progress.Download = &p
+}
+
+func (s *syncState) endRegion() {
+	s.mu.Lock()
+	s.progress.Running = false
+	s.progress.Current = ""
+	s.progress.Download = nil
+	r, oldest := s.addRunLocked(RunRecord{
+		Region:    s.progress.Region,
+		StartedAt: s.progress.StartedAt,
+		EndedAt:   time.Now(),
+		Total:     s.progress.Total,
+		Succeeded: s.progress.Done - s.progress.Failed,
+		Failed:    s.progress.Failed,
+	})
+	s.mu.Unlock()
+	saveRun(r, oldest)
+}
+
+// 记录一次未进入逐条同步就失败的执行
+func (s *syncState) regionError(region string, startedAt time.Time, err error) {
+	s.mu.Lock()
+	r, oldest := s.addRunLocked(RunRecord{
+		Region:    region,
+		StartedAt: startedAt,
+		EndedAt:   time.Now(),
+		Error:     err.Error(),
+	})
+	s.mu.Unlock()
+	saveRun(r, oldest)
+}
+
+// 返回带ID的记录和保留的最旧记录ID
+func (s *syncState) addRunLocked(r RunRecord) (RunRecord, int64) {
+	r.ID = time.Now().UnixNano()
+	s.runs = append(s.runs, r)
+	if len(s.runs) > maxRuns {
+		s.runs = s.runs[len(s.runs)-maxRuns:]
+	}
+	return r, s.runs[0].ID
+}
+
+// 按时间倒序返回执行记录
+func (s *syncState) listRuns() []RunRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]RunRecord, 0, len(s.runs))
+	for i := len(s.runs) - 1; i >= 0; i-- {
+		list = append(list, s.runs[i])
+	}
+	return list
+}
+
+func (s *syncState) getProgress() JobProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.progress
+}
+
+// 记录一次失败 同一region同一log只保留最新一条
+func (s *syncState) addFailure(region string, job string, fl FileLog, err error) {
+	s.mu.Lock()
+	removed := s.removeLocked(region, job, fl)
+	s.nextID++
+	f := Failure{
+		ID:     s.nextID,
+		Region: region,
+		Job:    job,
+		Log:    fl,
+		Error:  err.Error(),
+		Time:   time.Now(),
+
+		Permanent: isPermanentError(err),
+	}
+	s.failures = append(s.failures, f)
+	oldest := 0
+	if len(s.failures) > maxFailures {
+		s.failures = s.failures[len(s.failures)-maxFailures:]
+		oldest = s.failures[0].ID
+	}
+	s.mu.Unlock()
+	saveFailure(&f, removed, oldest)
+}
+
+// 同步成功后清除该log之前的失败记录
+func (s *syncState) clearFailure(region string, job string, fl FileLog) {
+	s.mu.Lock()
+	removed := s.removeLocked(region, job, fl)
+	s.mu.Unlock()
+	if removed > 0 {
+		saveFailure(nil, removed, 0)
+	}
+}
+
+// 删除同一log的失败记录 返回其ID 无记录时为0
+func (s *syncState) removeLocked(region string, job string, fl FileLog) int {
+	for i, f := range s.failures {
+		if f.Region == region && f.Job == job && f.Log.SEQUENCE == fl.SEQUENCE && f.Log.SameKeys(fl) {
+			s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			return f.ID
+		}
+	}
+	return 0
+}
+
+// 按时间倒序返回失败记录
+func (s *syncState) listFailures() []Failure {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Failure, 0, len(s.failures))
+	for i := len(s.failures) - 1; i >= 0; i-- {
+		list = append(list, s.failures[i])
+	}
+	return list
+}
+
+func (s *syncState) getFailure(id int) (Failure, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range s.failures {
+		if f.ID == id {
+			return f, true
+		}
+	}
+	return Failure{}, false
+}
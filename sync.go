@@ -2,9 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -13,6 +16,7 @@ import (
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel/attribute"
 	"prospect_file_sync/config"
 	"prospect_file_sync/database"
 	"prospect_file_sync/util"
@@ -24,72 +28,392 @@ var xjToken = ""
 
 func SyncFiles(rc config.RegionConfig) {
 	logger.Printf("------------------ %s sync files.start ------------------\r\n", rc.Name)
+	startedAt := time.Now()
+	ctx, span := startSpan(context.Background(), "SyncFiles", rc.Name, nil)
+	var err error
+	defer func() { endSpan(span, err) }()
 
 	// 1. init origin db connection
-	originDB, err := database.ConnectDB(rc.DB)
+	var originDB *sqlx.DB
+	originDB, err = database.ConnectDB(rc.DB)
 	if err != nil {
 		logger.Printf("%s originDB init error: %s\r\n", rc.Name, err.Error())
+		state.regionError(rc.Name, startedAt, err)
 		return
 	}
 	defer originDB.Close()
 
 	// 如果是xj油田先登录获取token
-	xjToken, err = loginXj(rc)
+	xjToken, err = loginXj(ctx, rc)
 	if err != nil {
 		logger.Printf("%s loginXj error:%s\r\n", rc.Name, err.Error())
+		state.regionError(rc.Name, startedAt, err)
 		return
 	}
 
-	// 2. queryFileLogsToSync
-	fls := make([]FileLog, 0)
-	rows, err := queryFileLogsToSync(originDB, rc.DB.LogTable)
+	// 2. 查询各同步表待同步的log
+	tasks := make([]jobLog, 0)
+	watermarks := watermarkRun{}
+	for _, job := range regionJobs(rc) {
+		if isTimestampJob(job) {
+			jls, jerr := watermarks.load(ctx, originDB, rc, job)
+			if jerr != nil {
+				logger.Printf("%s[%s] queryChangedFiles error:%s\r\n", rc.Name, job.Name, jerr.Error())
+				err = fmt.Errorf("%s: %s", job.Name, jerr.Error())
+				state.regionError(rc.Name, startedAt, err)
+				continue
+			}
+			logger.Printf("%s[%s] %d changed files to sync\r\n", rc.Name, job.Name, len(jls))
+			tasks = append(tasks, jls...)
+			continue
+		}
+
+		fls, jerr := loadFileLogs(ctx, originDB, rc, job)
+		if jerr != nil {
+			logger.Printf("%s[%s] queryFileLogsToSync error:%s\r\n", rc.Name, job.Name, jerr.Error())
+			err = fmt.Errorf("%s: %s", job.Name, jerr.Error())
+			state.regionError(rc.Name, startedAt, err)
+			continue
+		}
+
+		logger.Printf("%s[%s] %d logs to sync\r\n", rc.Name, job.Name, len(fls))
+		for _, fl := range fls {
+			tasks = append(tasks, jobLog{job: job, fl: fl})
+		}
+	}
+
+	// 批量删除拦截 超过阈值且未批准时本次不执行删除
+	if !checkDeleteGuard(ctx, rc, tasks) {
+		watermarks.holdDeletes()
+		tasks = beforeDeletes(tasks)
+	}
+
+	// 3. foreach files
+	state.startRegion(rc.Name, len(tasks))
+	defer state.endRegion()
+	origin := dbOrigin{db: originDB, rc: rc}
+	blocked := map[string]bool{} // 检查点模式下失败的同步表 本次跳过其后的log 下次从失败处继续
+	for _, t := range tasks {
+		if blocked[t.job.Name] {
+			state.itemDone(nil)
+			continue
+		}
+		state.setCurrent(t.job.Name, t.fl)
+		serr := syncLog(ctx, origin, rc, t.job, t.fl)
+		state.itemDone(serr)
+		if isTimestampJob(t.job) {
+			watermarks.done(t, serr)
+			continue
+		}
+		if serr != nil && !isPermanentError(serr) && isCheckpoint(rc) {
+			logger.Printf("%s[%s] 检查点停在%s之前 本次跳过其后的log\r\n", rc.Name, t.job.Name, t.fl.SEQUENCE)
+			blocked[t.job.Name] = true
+		}
+	}
+	watermarks.save(ctx)
+
+	logger.Printf("------------------ %s sync files end ------------------\r\n", rc.Name)
+}
+
+// 待同步的一条log及其所属同步表
+type jobLog struct {
+	job config.SyncJob
+	fl  FileLog
+	ts  time.Time // 时间戳增量同步的记录修改时间
+}
+
+// 源头库 拉取时为油田数据库 推送模式时为油田agent推送的记录
+type originSource interface {
+	// 查询源头库文件详情 已按列映射转换为目标库列
+	queryFile(ctx context.Context, job config.SyncJob, cols []config.ColumnMapping, fl FileLog) (FileRow, error)
+	// 删除已同步的log
+	deleteLog(ctx context.Context, job config.SyncJob, fl FileLog) error
+}
+
+type dbOrigin struct {
+	db *sqlx.DB
+	rc config.RegionConfig
+}
+
+func (o dbOrigin) queryFile(ctx context.Context, job config.SyncJob, cols []config.ColumnMapping, fl FileLog) (FileRow, error) {
+	return queryOriginFile(ctx, o.db, job.FileTable, cols, fl)
+}
+
+// 检查点模式下不删除log 推进检查点
+func (o dbOrigin) deleteLog(ctx context.Context, job config.SyncJob, fl FileLog) error {
+	if isCheckpoint(o.rc) {
+		return saveCheckpoint(ctx, o.rc.Name, job.LogTable, fl.SEQUENCE)
+	}
+	return deleteLogRecord(ctx, o.db, fl, job.LogTable)
+}
+
+// 查询同步表的全部待同步log
+func loadFileLogs(ctx context.Context, originDB *sqlx.DB, rc config.RegionConfig, job config.SyncJob) ([]FileLog, error) {
+	if err := checkJob(job); err != nil {
+		return nil, err
+	}
+	if isTimestampJob(job) {
+		return nil, errors.New("时间戳增量同步表无log 仅拉取模式")
+	}
+
+	after := ""
+	var seen map[string]bool // 检查点之前重新查询的窗口内已同步的log
+	if isCheckpoint(rc) {
+		var err error
+		if after, seen, err = loadCheckpointWindow(ctx, rc, job.LogTable); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := queryFileLogsToSync(ctx, originDB, job.LogTable, after)
 	if err != nil {
-		logger.Printf("%s queryFileLogsToSync error:%s\r\n", rc.Name, err.Error())
-		return
+		return nil, err
 	}
+	defer rows.Close()
 
+	fls := make([]FileLog, 0)
 	for rows.Next() {
-		var fl FileLog
-		if err := rows.StructScan(&fl); err != nil {
-			logger.Printf("%s StructScan error:%s\r\n", rc.Name, err.Error())
+		row, err := scanFileRow(rows)
+		if err != nil {
+			logger.Printf("%s scanFileRow error:%s\r\n", rc.Name, err.Error())
+			continue
 		}
 
+		fl := fileLogFromRow(row, job.KeyColumns)
+		if len(fl.SEQUENCE) == 0 {
+			logger.Printf("%s log SEQUENCE$$ is null: %v\r\n", rc.Name, row)
+			continue
+		}
+		if seen[fl.SEQUENCE] {
+			continue
+		}
 		fls = append(fls, fl)
 	}
-	rows.Close()
+	return fls, rows.Err()
+}
 
-	// 3. foreach files
-	logger.Printf("%d logs to sync\n", len(fls))
-	for _, fl := range fls {
-		logger.Printf("****** %s %s[%s] %s-%s sync ******\r\n", rc.Name, fl.SEQUENCE, fl.DMLTYPE, fl.JH, fl.WDMC)
+// 按DMLTYPE同步单条log 失败时记录到失败列表
+func syncLog(ctx context.Context, origin originSource, rc config.RegionConfig, job config.SyncJob, fl FileLog) error {
+	logger.Printf("****** %s[%s] %s[%s] %s sync ******\r\n", rc.Name, job.Name, fl.SEQUENCE, fl.DMLTYPE, fl.KeyString())
+	defer logger.Printf("****** sync end ******\r\n")
 
-		switch fl.DMLTYPE {
-		case "I":
-			addFile(originDB, rc, fl)
-		case "D":
-			deleteFile(originDB, rc, fl)
-		case "U":
-			updateFile(originDB, rc, fl)
-		default:
-			logger.Printf("%s DMLTYPE error:%s is not in ['I','D','U']\r\n", rc.Name, fl.DMLTYPE)
+	var err error
+	switch fl.DMLTYPE {
+	case "I":
+		err = addFile(ctx, origin, rc, job, fl)
+	case "D":
+		err = deleteFile(ctx, origin, rc, job, fl)
+	case "U":
+		err = updateFile(ctx, origin, rc, job, fl)
+	default:
+		err = fmt.Errorf("DMLTYPE error:%s is not in ['I','D','U']", fl.DMLTYPE)
+		logger.Printf("%s %s\r\n", rc.Name, err.Error())
+	}
+
+	if err != nil && isPermanentError(err) {
+		// 内容校验失败重试无意义 删除log不再同步 保留在失败记录中可手动重新同步
+		logger.Printf("%s[%s] %s 永久失败:%s\r\n", rc.Name, job.Name, fl.KeyString(), err.Error())
+		if derr := origin.deleteLog(ctx, job, fl); derr != nil {
+			logger.Printf("%s deleteLogRecord[syncLog] error:%s\r\n", rc.Name, derr.Error())
 		}
+		state.addFailure(rc.Name, job.Name, fl, err)
+	} else if err != nil {
+		state.addFailure(rc.Name, job.Name, fl, err)
+	} else {
+		state.clearFailure(rc.Name, job.Name, fl)
+	}
+	return err
+}
+
+// 重新同步一条失败记录
+func requeueFailure(f Failure) error {
+	rc, ok := findRegion(f.Region)
+	if !ok {
+		return fmt.Errorf("region %s not found", f.Region)
+	}
+	job, ok := findJob(rc, f.Job)
+	if !ok {
+		return fmt.Errorf("job %s not found", f.Job)
+	}
+	if rc.Push {
+		return errPushRegion
+	}
 
-		logger.Printf("****** sync end ******\r\n")
+	originDB, err := database.ConnectDB(rc.DB)
+	if err != nil {
+		return err
 	}
+	defer originDB.Close()
 
-	logger.Printf("------------------ %s sync files end ------------------\r\n", rc.Name)
+	ctx := context.Background()
+	xjToken, err = loginXj(ctx, rc)
+	if err != nil {
+		return err
+	}
+
+	return syncLog(ctx, dbOrigin{db: originDB, rc: rc}, rc, job, f.Log)
 }
 
-// 查询需要同步的文件列表
-func queryFileLogsToSync(db *sqlx.DB, logTableName string) (*sqlx.Rows, error) {
+// 手动重新同步一条目标库记录 按U处理 无对应log
+func resyncItem(rc config.RegionConfig, job config.SyncJob, fl FileLog) error {
+	if rc.Push {
+		return errPushRegion
+	}
+	originDB, err := database.ConnectDB(rc.DB)
+	if err != nil {
+		return err
+	}
+	defer originDB.Close()
+
+	ctx := context.Background()
+	xjToken, err = loginXj(ctx, rc)
+	if err != nil {
+		return err
+	}
+
+	fl.SEQUENCE = ""
+	fl.DMLTYPE = "U"
+	return syncLog(ctx, dbOrigin{db: originDB, rc: rc}, rc, job, fl)
+}
+
+// 目标库查询结果 带所属油田和同步表 用于重新同步
+type searchHit struct {
+	Region string     `json:"region"`
+	Job    string     `json:"job"`
+	Keys   []KeyValue `json:"keys"`
+	Path   string     `json:"path"`
+	Row    FileRow    `json:"row"`
+}
+
+// 按主键列或文件路径模糊查询各油田各同步表的目标库记录 油田按落盘目录区分
+func searchTargetFiles(keyword string, limit int) ([]searchHit, error) {
+	like := "%" + escapeLike(keyword) + "%"
+	hits := make([]searchHit, 0)
+	seen := map[string]bool{} // 共用目标表且未配置storeDir的同步表 同一记录只返回一次
+	for _, rc := range cfg.Regions {
+		for _, job := range regionJobs(rc) {
+			if len(hits) >= limit {
+				return hits, nil
+			}
+			if len(job.TargetTable) == 0 {
+				continue
+			}
+			dirLike, err := jobPathLike(rc, job)
+			if err != nil {
+				return nil, err
+			}
+
+			args := []interface{}{dirLike}
+			conds := make([]string, 0, len(job.KeyColumns)+1)
+			for _, col := range append(append([]string{}, job.KeyColumns...), job.PathColumn) {
+				args = append(args, like)
+				conds = append(conds, fmt.Sprintf(`%s LIKE :%d ESCAPE '\'`, col, len(args)))
+			}
+			args = append(args, limit-len(hits))
+			sql := fmt.Sprintf(`SELECT * FROM (SELECT * FROM "%s" WHERE %s LIKE :1 ESCAPE '\' AND (%s)) WHERE ROWNUM <= :%d`,
+				job.TargetTable, job.PathColumn, strings.Join(conds, " OR "), len(args))
+			rows, err := targetDB.Queryx(sql, args...)
+			if err != nil {
+				return nil, fmt.Errorf("%s[%s]: %s", rc.Name, job.Name, err.Error())
+			}
+			for rows.Next() {
+				row, err := scanFileRow(rows)
+				if err != nil {
+					rows.Close()
+					return nil, err
+				}
+				fl := fileLogFromRow(row, job.KeyColumns)
+				id := rc.Name + "/" + job.TargetTable + "/" + fl.KeyString()
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+				hits = append(hits, searchHit{Region: rc.Name, Job: job.Name, Keys: fl.Keys, Path: row.Str(job.PathColumn), Row: row})
+			}
+			err = rows.Err()
+			rows.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return hits, nil
+}
+
+// 查询源头库各同步表待同步的log数量之和
+func pendingLogCount(rc config.RegionConfig) (int, error) {
+	if rc.Push {
+		return 0, nil // log在油田 由agent推送
+	}
+	originDB, err := database.ConnectDB(rc.DB)
+	if err != nil {
+		return 0, err
+	}
+	defer originDB.Close()
+
+	total := 0
+	for _, job := range regionJobs(rc) {
+		if err := checkJob(job); err != nil {
+			return total, fmt.Errorf("%s: %s", job.Name, err.Error())
+		}
+		if isTimestampJob(job) {
+			count, err := pendingTimestampCount(context.Background(), originDB, rc, job)
+			if err != nil {
+				return total, err
+			}
+			total += count
+			continue
+		}
+
+		after := ""
+		if isCheckpoint(rc) {
+			if after, err = loadCheckpoint(context.Background(), rc.Name, job.LogTable); err != nil {
+				return total, err
+			}
+		}
+		var count int
+		if len(after) > 0 {
+			err = originDB.Get(&count, fmt.Sprintf("SELECT COUNT(*) FROM \"%s\" WHERE SEQUENCE$$ > :1", job.LogTable), after)
+		} else {
+			err = originDB.Get(&count, fmt.Sprintf("SELECT COUNT(*) FROM \"%s\"", job.LogTable))
+		}
+		if err != nil {
+			return total, err
+		}
+		total += count
+	}
+
+	return total, nil
+}
+
+func findRegion(name string) (config.RegionConfig, bool) {
+	for _, rc := range cfg.Regions {
+		if rc.Name == name {
+			return rc, true
+		}
+	}
+	return config.RegionConfig{}, false
+}
+
+// 查询需要同步的文件列表 after不为空时只查询SEQUENCE$$ > after的log
+func queryFileLogsToSync(ctx context.Context, db *sqlx.DB, logTableName string, after string) (*sqlx.Rows, error) {
 	if len(logTableName) == 0 {
 		return nil, errors.New("logTableName is null")
 	}
 
+	ctx, span := startDBSpan(ctx, "queryFileLogsToSync", logTableName)
+	defer span.End()
+
 	sql := fmt.Sprintf("SELECT * FROM \"%s\" ORDER BY SEQUENCE$$", logTableName)
+	args := []interface{}{}
+	if len(after) > 0 {
+		sql = fmt.Sprintf("SELECT * FROM \"%s\" WHERE SEQUENCE$$ > :1 ORDER BY SEQUENCE$$", logTableName)
+		args = append(args, after)
+	}
 	udb := db.Unsafe()
-	rows, err := udb.Queryx(sql)
+	rows, err := udb.QueryxContext(ctx, sql, args...)
 	if err != nil {
+		span.RecordError(err)
 		return nil, err
 	}
 
@@ -97,239 +421,354 @@ func queryFileLogsToSync(db *sqlx.DB, logTableName string) (*sqlx.Rows, error) {
 }
 
 // action I : 同步insert文件和文件表记录 并删除log记录
-func addFile(originDB *sqlx.DB, rc config.RegionConfig, fl FileLog) {
-	originLogTableName := rc.DB.LogTable
-	originTableName := rc.DB.FileTable
-	targetTableName := cfg.Target.DB.FileTable
+func addFile(ctx context.Context, origin originSource, rc config.RegionConfig, job config.SyncJob, fl FileLog) (err error) {
+	ctx, span := startSpan(ctx, "addFile", rc.Name, &fl)
+	defer func() { endSpan(span, err) }()
+
+	targetTableName := job.TargetTable
+	cols := jobColumns(job)
 
-	// 1. 查询源头库文件详情
-	ft, err := queryFile(originDB, originTableName, fl)
+	// 1. 查询源头库文件详情 记录已被删除时跳过 由其后的D处理
+	ft, err := origin.queryFile(ctx, job, cols, fl)
+	if errors.Is(err, sql.ErrNoRows) {
+		return skipLog(ctx, origin, rc, job, fl, "源头库记录已删除")
+	}
 	if err != nil {
 		logger.Printf("%s queryFile[addFile] error:%s\r\n", rc.Name, err.Error())
-		return
+		return err
 	}
 
 	// 2. 下载文件
 	// downloadUrl := getFileDownloadUrl(ft, rc) // 源服务器文件下载地址
 	// storePath := getFileStorePath(ft, rc, fl) // 目标服务器文件落盘地址
 	// err = util.DownloadFile(storePath, downloadUrl)
-	downloadUrl, storePath, err := downloadFile(ft, rc, fl)
+	f, err := downloadFile(ctx, ft, rc, job, fl, false)
 	if err != nil {
 		logger.Printf("%s downloadFile[addFile] error:%s\r\n", rc.Name, err.Error())
-		return
+		return err
 	} else {
-		logger.Printf("%s downloadFile[addFile]:%s\r\n", rc.Name, downloadUrl)
+		logger.Printf("%s downloadFile[addFile]:%s\r\n", rc.Name, f.url)
+	}
+	storePath := f.storePath
+	// 源文件未变化时未写入新文件 已落盘的文件已通过preStore 失败时也不能删除
+	written := !f.result.NotModified
+	if written {
+		if err = runHooks(ctx, hookPreStore, rc, job, fl, ft, storePath); err != nil {
+			if derr := util.DeleteFile(storePath); derr != nil {
+				logger.Printf("%s DeleteFile[preStore] error:%s\r\n", rc.Name, derr.Error())
+			}
+			return err
+		}
 	}
 
 	// 3. 写目标库FileTable表
-	count, err := queryCount(targetDB, targetTableName, fl)
+	count, err := queryCount(ctx, targetDB, targetTableName, fl)
 	if err != nil {
 		logger.Printf("%s queryCount[addFile] error:%s\r\n", rc.Name, err.Error())
 	}
 	if count > 0 { // 删除目标库重复的旧记录
-		err = deleteFileRecord(targetDB, fl, targetTableName)
+		err = deleteFileRecord(ctx, targetDB, fl, targetTableName)
 		if err != nil {
 			logger.Printf("%s deleteFileRecord[addFile] error:%s\r\n", rc.Name, err.Error())
-			return
+			return err
 		}
 	}
 	// insert file table
-	ft.CFLJ = getFileFTPPath(storePath) // 修改target库存储的文件路径 2.3使用FTP地址供勘探系统内页面使用
-	err = insertFileRecord(targetDB, ft, targetTableName)
+	ft[job.PathColumn] = getFileFTPPath(storePath) // 修改target库存储的文件路径 2.3使用FTP地址供勘探系统内页面使用
+	err = insertFileRecord(ctx, targetDB, ft, cols, targetTableName)
 	if err != nil {
 		logger.Printf("%s insertFileRecord[addFile] error:%s\r\n", rc.Name, err.Error())
 
 		// 删除刚落盘的文件
-		err = util.DeleteFile(storePath)
-		if err != nil {
-			logger.Printf("%s DeleteFile[addFile] error:%s\r\n", rc.Name, err.Error())
+		if written {
+			if derr := util.DeleteFile(storePath); derr != nil {
+				logger.Printf("%s DeleteFile[addFile] error:%s\r\n", rc.Name, derr.Error())
+			}
 		}
-		return
+		return err
 	}
 
 	// 4. 删源头库log表
-	err = deleteLogRecord(originDB, fl, originLogTableName)
+	err = origin.deleteLog(ctx, job, fl)
 	if err != nil {
 		logger.Printf("%s deleteLogRecord[addFile] error:%s\r\n", rc.Name, err.Error())
 
 		// 删除刚落盘的文件
-		err = util.DeleteFile(storePath)
-		if err != nil {
-			logger.Printf("%s DeleteFile[addFile] error:%s\r\n", rc.Name, err.Error())
+		if written {
+			if derr := util.DeleteFile(storePath); derr != nil {
+				logger.Printf("%s DeleteFile[addFile] error:%s\r\n", rc.Name, derr.Error())
+			}
 		}
 
 		// 删除目标库刚insert的记录
-		err = deleteFileRecord(targetDB, fl, targetTableName)
-		if err != nil {
-			logger.Printf("%s deleteFileRecord[addFile] error:%s\r\n", rc.Name, err.Error())
+		if derr := deleteFileRecord(ctx, targetDB, fl, targetTableName); derr != nil {
+			logger.Printf("%s deleteFileRecord[addFile] error:%s\r\n", rc.Name, derr.Error())
 		}
 
-		return
+		return err
 	}
+
+	return runHooks(ctx, hookPostStore, rc, job, fl, ft, storePath)
 }
 
 // action U : 同步update文件和文件表记录 并删除log记录
-func updateFile(originDB *sqlx.DB, rc config.RegionConfig, fl FileLog) {
-	originLogTableName := rc.DB.LogTable
-	originTableName := rc.DB.FileTable
-	targetTableName := cfg.Target.DB.FileTable
+func updateFile(ctx context.Context, origin originSource, rc config.RegionConfig, job config.SyncJob, fl FileLog) (err error) {
+	ctx, span := startSpan(ctx, "updateFile", rc.Name, &fl)
+	defer func() { endSpan(span, err) }()
+
+	targetTableName := job.TargetTable
+	cols := jobColumns(job)
 
 	// 1. 查询目标库文件详情
-	ftt, err := queryFile(targetDB, targetTableName, fl)
+	ftt, err := queryTargetFile(ctx, targetDB, targetTableName, cols, fl)
 	if err != nil {
 		logger.Printf("%s queryFile[deleteFile] error:%s\r\n", rc.Name, err.Error())
 		logger.Println("U转I")
-		addFile(originDB, rc, fl)
-		return
+		return addFile(ctx, origin, rc, job, fl)
 	}
 
-	// 2. 删除目标服务器落盘的文件
-	oldPath := ftpToStorePath(ftt.CFLJ)
-	err = util.DeleteFile(oldPath)
+	// 2. 查询源头库文件详情 记录已被删除时跳过 由其后的D处理
+	ft, err := origin.queryFile(ctx, job, cols, fl)
+	if errors.Is(err, sql.ErrNoRows) {
+		return skipLog(ctx, origin, rc, job, fl, "源头库记录已删除")
+	}
 	if err != nil {
-		logger.Printf("%s DeleteFile[deleteFile] error:%s\r\n", rc.Name, err.Error())
-	} else {
-		logger.Printf("%s DeleteFile[deleteFile]:%s\r\n", rc.Name, oldPath)
+		logger.Printf("%s queryFile[addFile] error:%s\r\n", rc.Name, err.Error())
+		return err
 	}
 
-	// 3. 删除目标库insert的记录
-	err = deleteFileRecord(targetDB, fl, targetTableName)
-	if err != nil {
-		logger.Printf("%s deleteFileRecord[deleteFile] error:%s\r\n", rc.Name, err.Error())
+	// 3. 文件未变化时仅更新元数据 不重新下载
+	if isMetadataOnlyUpdate(ctx, ft, ftt, rc, job, fl) {
+		err = updateFileRecord(ctx, targetDB, ft, cols, job, fl, targetTableName)
+		if err != nil {
+			logger.Printf("%s updateFileRecord[updateFile] error:%s\r\n", rc.Name, err.Error())
+			return err
+		}
+
+		err = origin.deleteLog(ctx, job, fl)
+		if err != nil {
+			logger.Printf("%s deleteLogRecord[updateFile] error:%s\r\n", rc.Name, err.Error())
+			return err
+		}
+		ft[job.PathColumn] = ftt[job.PathColumn]
+		return runHooks(ctx, hookPostStore, rc, job, fl, ft, ftpToStorePath(ftt.Str(job.PathColumn)))
 	}
 
-	// 4. 查询源头库文件详情
-	ft, err := queryFile(originDB, originTableName, fl)
+	// 4. 下载到暂存地址 内容校验和preStore通过后再替换旧文件 失败时已落盘的文件和目标库记录不变
+	f, err := downloadFile(ctx, ft, rc, job, fl, true)
 	if err != nil {
-		logger.Printf("%s queryFile[addFile] error:%s\r\n", rc.Name, err.Error())
-		return
+		logger.Printf("%s downloadFile[updateFile] error:%s\r\n", rc.Name, err.Error())
+		return err
+	}
+	logger.Printf("%s downloadFile[updateFile]:%s\r\n", rc.Name, f.url)
+	storePath := f.storePath
+	if err = runHooks(ctx, hookPreStore, rc, job, fl, ft, f.path); err != nil {
+		if derr := util.DeleteFile(f.path); derr != nil {
+			logger.Printf("%s DeleteFile[preStore] error:%s\r\n", rc.Name, derr.Error())
+		}
+		return err
 	}
 
-	// 5. 下载文件
-	// downloadUrl := getFileDownloadUrl(ft, rc) // 源服务器文件下载地址
-	// storePath := getFileStorePath(ft, rc, fl) // 目标服务器文件落盘地址
-	// err = util.DownloadFile(storePath, downloadUrl)
-	downloadUrl, storePath, err := downloadFile(ft, rc, fl)
-	if err != nil {
-		logger.Printf("%s downloadFile[addFile] error:%s\r\n", rc.Name, err.Error())
-		return
+	// 5. 目标服务器落盘的旧文件保留为历史版本或移入回收站 失败时保留log下次重试
+	oldPath := ftpToStorePath(ftt.Str(job.PathColumn))
+	if _, serr := util.FS.Stat(oldPath); errors.Is(serr, fs.ErrNotExist) {
+		logger.Printf("%s 旧文件不存在 无需保留:%s\r\n", rc.Name, oldPath)
+	} else if cfg.Versioning.Enabled {
+		err = saveVersion(ctx, rc, job, fl, ftt, oldPath)
+		if err == nil {
+			pruneVersions(ctx, rc.Name, job.Name, fl.KeyString())
+		}
 	} else {
-		logger.Printf("%s downloadFile[addFile]:%s\r\n", rc.Name, downloadUrl)
+		err = moveToTrash(ctx, rc, job, fl, ftt, oldPath, "U")
+	}
+	if err != nil {
+		logger.Printf("%s saveVersion/moveToTrash[updateFile] error:%s\r\n", rc.Name, err.Error())
+		if derr := util.DeleteFile(f.path); derr != nil {
+			logger.Printf("%s DeleteFile[updateFile] error:%s\r\n", rc.Name, derr.Error())
+		}
+		return err
 	}
 
-	// 6. 写目标库FileTable表
-	count, err := queryCount(targetDB, targetTableName, fl)
+	// 6. 暂存文件替换为落盘文件
+	if err = util.FS.Rename(f.path, storePath); err != nil {
+		logger.Printf("%s Rename[updateFile] error:%s\r\n", rc.Name, err.Error())
+		if derr := util.DeleteFile(f.path); derr != nil {
+			logger.Printf("%s DeleteFile[updateFile] error:%s\r\n", rc.Name, derr.Error())
+		}
+		return err
+	}
+	if err = saveFileMeta(ctx, storePath, f.result); err != nil {
+		logger.Printf("%s saveFileMeta error:%s\r\n", rc.Name, err.Error())
+	}
+
+	// 7. 写目标库FileTable表
+	count, err := queryCount(ctx, targetDB, targetTableName, fl)
 	if err != nil {
 		logger.Printf("%s queryCount[addFile] error:%s\r\n", rc.Name, err.Error())
 	}
 	if count > 0 { // 删除目标库重复的旧记录
-		err = deleteFileRecord(targetDB, fl, targetTableName)
+		err = deleteFileRecord(ctx, targetDB, fl, targetTableName)
 		if err != nil {
 			logger.Printf("%s deleteFileRecord[addFile] error:%s\r\n", rc.Name, err.Error())
-			return
+			return err
 		}
 	}
 	// insert file table
-	ft.CFLJ = getFileFTPPath(storePath) // 修改target库存储的文件路径 2.3使用FTP地址供勘探系统内页面使用
-	err = insertFileRecord(targetDB, ft, targetTableName)
+	ft[job.PathColumn] = getFileFTPPath(storePath) // 修改target库存储的文件路径 2.3使用FTP地址供勘探系统内页面使用
+	err = insertFileRecord(ctx, targetDB, ft, cols, targetTableName)
 	if err != nil {
 		logger.Printf("%s insertFileRecord[addFile] error:%s\r\n", rc.Name, err.Error())
 
 		// 删除刚落盘的文件
-		err = util.DeleteFile(storePath)
-		if err != nil {
-			logger.Printf("%s DeleteFile[addFile] error:%s\r\n", rc.Name, err.Error())
+		if derr := util.DeleteFile(storePath); derr != nil {
+			logger.Printf("%s DeleteFile[addFile] error:%s\r\n", rc.Name, derr.Error())
 		}
-		return
+		return err
 	}
 
-	// 7. 删源头库log表
-	err = deleteLogRecord(originDB, fl, originLogTableName)
+	// 8. 删源头库log表
+	err = origin.deleteLog(ctx, job, fl)
 	if err != nil {
 		logger.Printf("%s deleteLogRecord[addFile] error:%s\r\n", rc.Name, err.Error())
 
 		// 删除刚落盘的文件
-		err = util.DeleteFile(storePath)
-		if err != nil {
-			logger.Printf("%s DeleteFile[addFile] error:%s\r\n", rc.Name, err.Error())
+		if derr := util.DeleteFile(storePath); derr != nil {
+			logger.Printf("%s DeleteFile[addFile] error:%s\r\n", rc.Name, derr.Error())
 		}
 
 		// 删除目标库刚insert的记录
-		err = deleteFileRecord(targetDB, fl, targetTableName)
-		if err != nil {
-			logger.Printf("%s deleteFileRecord[addFile] error:%s\r\n", rc.Name, err.Error())
+		if derr := deleteFileRecord(ctx, targetDB, fl, targetTableName); derr != nil {
+			logger.Printf("%s deleteFileRecord[addFile] error:%s\r\n", rc.Name, derr.Error())
 		}
 
-		return
+		return err
 	}
+
+	return runHooks(ctx, hookPostStore, rc, job, fl, ft, storePath)
 }
 
 // action D : 同步delete文件 并删除log记录
-func deleteFile(originDB *sqlx.DB, rc config.RegionConfig, fl FileLog) {
-	originLogTableName := rc.DB.LogTable
-	targetTableName := cfg.Target.DB.FileTable
+func deleteFile(ctx context.Context, origin originSource, rc config.RegionConfig, job config.SyncJob, fl FileLog) (err error) {
+	ctx, span := startSpan(ctx, "deleteFile", rc.Name, &fl)
+	defer func() { endSpan(span, err) }()
 
-	// 1. 查询目标库文件详情
-	ft, err := queryFile(targetDB, targetTableName, fl)
+	targetTableName := job.TargetTable
+
+	// 1. 查询目标库文件详情 无记录时无需删除
+	ft, err := queryTargetFile(ctx, targetDB, targetTableName, jobColumns(job), fl)
+	if errors.Is(err, sql.ErrNoRows) {
+		return skipLog(ctx, origin, rc, job, fl, "目标库无记录")
+	}
 	if err != nil {
 		logger.Printf("%s queryFile[deleteFile] error:%s\r\n", rc.Name, err.Error())
-		return
+		return err
 	}
 
-	// 2. 删除目标服务器落盘的文件
-	storePath := ftpToStorePath(ft.CFLJ)
-	err = util.DeleteFile(storePath)
-	if err != nil {
-		logger.Printf("%s DeleteFile[deleteFile] error:%s\r\n", rc.Name, err.Error())
-	} else {
-		logger.Printf("%s DeleteFile[deleteFile]:%s\r\n", rc.Name, storePath)
+	// 2. 目标服务器落盘的文件移入回收站 失败时保留log下次重试 不删除无法恢复的记录
+	storePath := ftpToStorePath(ft.Str(job.PathColumn))
+	if _, serr := util.FS.Stat(storePath); errors.Is(serr, fs.ErrNotExist) {
+		logger.Printf("%s 落盘文件不存在 无需移入回收站:%s\r\n", rc.Name, storePath)
+	} else if err = moveToTrash(ctx, rc, job, fl, ft, storePath, "D"); err != nil {
+		logger.Printf("%s moveToTrash[deleteFile] error:%s\r\n", rc.Name, err.Error())
+		return err
+	}
+	if err = deleteFileMeta(ctx, storePath); err != nil {
+		logger.Printf("%s deleteFileMeta[deleteFile] error:%s\r\n", rc.Name, err.Error())
 	}
 
 	// 3. 删除目标库insert的记录
-	err = deleteFileRecord(targetDB, fl, targetTableName)
+	err = deleteFileRecord(ctx, targetDB, fl, targetTableName)
 	if err != nil {
 		logger.Printf("%s deleteFileRecord[deleteFile] error:%s\r\n", rc.Name, err.Error())
+		return err
 	}
 
 	// 4. 删源头库log表
-	err = deleteLogRecord(originDB, fl, originLogTableName)
+	err = origin.deleteLog(ctx, job, fl)
 	if err != nil {
 		logger.Printf("%s deleteLogRecord[deleteFile] error:%s\r\n", rc.Name, err.Error())
+		return err
 	}
+
+	return runHooks(ctx, hookPostDelete, rc, job, fl, ft, storePath)
+}
+
+// 记录已不存在 重试无意义 删除log(检查点模式下推进检查点)继续同步 否则该log每次都失败 检查点模式下阻塞其后的log
+func skipLog(ctx context.Context, origin originSource, rc config.RegionConfig, job config.SyncJob, fl FileLog, reason string) error {
+	logger.Printf("%s[%s] %s 跳过:%s\r\n", rc.Name, job.Name, fl.KeyString(), reason)
+	if err := origin.deleteLog(ctx, job, fl); err != nil {
+		logger.Printf("%s deleteLogRecord[skipLog] error:%s\r\n", rc.Name, err.Error())
+		return err
+	}
+	return nil
+}
+
+// 查询源头库文件详情 按列映射转换为目标库列
+func queryOriginFile(ctx context.Context, db *sqlx.DB, fileTableName string, cols []config.ColumnMapping, fl FileLog) (FileRow, error) {
+	row, err := queryFile(ctx, db, fileTableName, originSelectList(cols), fl)
+	if err != nil {
+		return nil, err
+	}
+	if err = applyTransforms(row, cols); err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+// 查询目标库文件详情
+func queryTargetFile(ctx context.Context, db *sqlx.DB, fileTableName string, cols []config.ColumnMapping, fl FileLog) (FileRow, error) {
+	return queryFile(ctx, db, fileTableName, targetSelectList(cols), fl)
 }
 
 // 查询文件详情 FileTable
-func queryFile(db *sqlx.DB, fileTableName string, fl FileLog) (FileTable, error) {
+func queryFile(ctx context.Context, db *sqlx.DB, fileTableName string, selectList string, fl FileLog) (ft FileRow, err error) {
 	if len(fileTableName) == 0 {
-		return FileTable{}, errors.New("fileTableName is null")
+		return nil, errors.New("fileTableName is null")
 	}
 
-	var ft FileTable
-	sql := fmt.Sprintf("SELECT DW,JH,WDMC,CFLJ,WDLX,WDZY,SJLB,BXDW,BXRQ,BZ FROM \"%s\" WHERE DW =:DW and JH =:JH and WDMC =:WDMC", fileTableName)
-	nstmt, err := db.PrepareNamed(sql)
-	err = nstmt.Get(&ft, fl)
+	ctx, span := startDBSpan(ctx, "queryFile", fileTableName)
+	defer func() { endSpan(span, err) }()
+
+	if len(fl.Keys) == 0 {
+		return nil, errors.New("key columns is null")
+	}
+
+	sql := fmt.Sprintf("SELECT %s FROM \"%s\" WHERE %s", selectList, fileTableName, fl.keyWhere())
+	nstmt, err := db.PrepareNamedContext(ctx, sql)
 	if err != nil {
-		return FileTable{}, err
+		return nil, err
 	}
+	defer nstmt.Close()
 
+	ft, err = scanFileRow(nstmt.QueryRowxContext(ctx, fl.keyArgs()))
 	if err != nil {
-		return FileTable{}, err
+		return nil, err
 	}
 
 	return ft, nil
 }
 
 // 查询文件数量 FileTable
-func queryCount(db *sqlx.DB, fileTableName string, fl FileLog) (int, error) {
+func queryCount(ctx context.Context, db *sqlx.DB, fileTableName string, fl FileLog) (count int, err error) {
 	if len(fileTableName) == 0 {
 		return 0, errors.New("fileTableName is null")
 	}
 
-	var count int
-	sql := fmt.Sprintf("SELECT COUNT(*) FROM \"%s\" WHERE DW =:DW and JH =:JH and WDMC =:WDMC", fileTableName)
+	ctx, span := startDBSpan(ctx, "queryCount", fileTableName)
+	defer func() { endSpan(span, err) }()
+
+	if len(fl.Keys) == 0 {
+		return 0, errors.New("key columns is null")
+	}
 
-	nstmt, err := db.PrepareNamed(sql)
-	err = nstmt.Get(&count, fl)
+	sql := fmt.Sprintf("SELECT COUNT(*) FROM \"%s\" WHERE %s", fileTableName, fl.keyWhere())
+	nstmt, err := db.PrepareNamedContext(ctx, sql)
+	if err != nil {
+		return 0, err
+	}
+	defer nstmt.Close()
+
+	err = nstmt.GetContext(ctx, &count, fl.keyArgs())
 	if err != nil {
 		return 0, err
 	}
@@ -338,42 +777,82 @@ func queryCount(db *sqlx.DB, fileTableName string, fl FileLog) (int, error) {
 }
 
 // insert 文件表FileTable
-func insertFileRecord(db *sqlx.DB, ft FileTable, fileTableName string) error {
-	sqlStr := fmt.Sprintf(`
-		insert into "%s"(DW, JH, WDMC, CFLJ, WDLX, WDZY, SJLB, BXDW, BXRQ, BZ) 
-		values (:DW, :JH, :WDMC, :CFLJ, :WDLX, :WDZY,:SJLB, :BXDW, :BXRQ, :BZ)
-	`, fileTableName)
+func insertFileRecord(ctx context.Context, db *sqlx.DB, ft FileRow, cols []config.ColumnMapping, fileTableName string) (err error) {
+	ctx, span := startDBSpan(ctx, "insertFileRecord", fileTableName)
+	defer func() { endSpan(span, err) }()
 
-	_, err := db.NamedExec(sqlStr, &ft)
+	sqlStr := buildInsertSQL(fileTableName, cols)
+	_, err = db.NamedExecContext(ctx, sqlStr, map[string]interface{}(ft))
 	if err != nil {
 		return err
 	}
 
-	logger.Printf("insert target record %s\r\n", ft.WDMC)
+	logger.Printf("insert target record %s\r\n", ft.Str("WDMC"))
 	return nil
 }
 
-// delete 文件表FileTable
-func deleteLogRecord(db *sqlx.DB, fl FileLog, tableName string) error {
+// update 文件表FileTable 仅更新主键和文件路径以外的列
+func updateFileRecord(ctx context.Context, db *sqlx.DB, ft FileRow, cols []config.ColumnMapping, job config.SyncJob, fl FileLog, fileTableName string) (err error) {
+	ctx, span := startDBSpan(ctx, "updateFileRecord", fileTableName)
+	defer func() { endSpan(span, err) }()
+
+	sqlStr := buildUpdateSQL(fileTableName, cols, job, fl.keyWhere())
+	if len(sqlStr) == 0 {
+		return nil
+	}
+	args := map[string]interface{}(ft)
+	for k, v := range fl.keyArgs() {
+		args[k] = v
+	}
+	_, err = db.NamedExecContext(ctx, sqlStr, args)
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("update target record %s\r\n", fl.KeyString())
+	return nil
+}
+
+// delete 源头库log表记录 手动同步(无SEQUENCE)时跳过
+func deleteLogRecord(ctx context.Context, db *sqlx.DB, fl FileLog, tableName string) (err error) {
+	if len(fl.SEQUENCE) == 0 {
+		return nil
+	}
+
+	ctx, span := startDBSpan(ctx, "deleteLogRecord", tableName)
+	defer func() { endSpan(span, err) }()
+
 	sql := fmt.Sprintf("DELETE FROM  \"%s\" WHERE SEQUENCE$$ = %s", tableName, fl.SEQUENCE)
-	_, err := db.Exec(sql)
+	_, err = db.ExecContext(ctx, sql)
 	if err != nil {
 		return err
 	}
 
-	logger.Printf("delete origin log %s(%s)\r\n", fl.SEQUENCE, fl.WDMC)
+	logger.Printf("delete origin log %s(%s)\r\n", fl.SEQUENCE, fl.KeyString())
 	return nil
 }
 
 // delete 文件表FileTable
-func deleteFileRecord(db *sqlx.DB, fl FileLog, tableName string) error {
-	sql := fmt.Sprintf("DELETE FROM  \"%s\" WHERE DW =:DW and JH =:JH and WDMC =:WDMC", tableName)
-	nstmt, err := db.PrepareNamed(sql)
-	_, err = nstmt.Exec(fl)
+func deleteFileRecord(ctx context.Context, db *sqlx.DB, fl FileLog, tableName string) (err error) {
+	ctx, span := startDBSpan(ctx, "deleteFileRecord", tableName)
+	defer func() { endSpan(span, err) }()
+
+	if len(fl.Keys) == 0 {
+		return errors.New("key columns is null")
+	}
+
+	sql := fmt.Sprintf("DELETE FROM  \"%s\" WHERE %s", tableName, fl.keyWhere())
+	nstmt, err := db.PrepareNamedContext(ctx, sql)
 	if err != nil {
 		return err
 	}
-	logger.Printf("delete target record %s\r\n", fl.WDMC)
+	defer nstmt.Close()
+
+	_, err = nstmt.ExecContext(ctx, fl.keyArgs())
+	if err != nil {
+		return err
+	}
+	logger.Printf("delete target record %s\r\n", fl.KeyString())
 	return nil
 }
 
@@ -384,35 +863,246 @@ func InitTargetDB(c config.Config) {
 	if err != nil {
 		logger.Fatalln("targetDB init error: " + err.Error())
 	}
+
+	if err = ensureMetaTable(); err != nil {
+		logger.Fatalln("targetDB ensureMetaTable error: " + err.Error())
+	}
+	if err = ensureTrashTable(); err != nil {
+		logger.Fatalln("targetDB ensureTrashTable error: " + err.Error())
+	}
+	if err = ensureGuardTable(); err != nil {
+		logger.Fatalln("targetDB ensureGuardTable error: " + err.Error())
+	}
+	if err = ensureCheckpointTable(); err != nil {
+		logger.Fatalln("targetDB ensureCheckpointTable error: " + err.Error())
+	}
+	if err = ensureWatermarkTable(); err != nil {
+		logger.Fatalln("targetDB ensureWatermarkTable error: " + err.Error())
+	}
+	warnNullTimestamps()
+	if err = ensureHistoryTables(); err != nil {
+		logger.Fatalln("targetDB ensureHistoryTables error: " + err.Error())
+	}
+	if err = loadHistory(); err != nil {
+		logger.Printf("targetDB loadHistory error:%s\r\n", err.Error())
+	}
+	if cfg.Versioning.Enabled {
+		if err = ensureVersionTable(); err != nil {
+			logger.Fatalln("targetDB ensureVersionTable error: " + err.Error())
+		}
+	}
 }
 
-// 下载具体静态文件落盘 分新疆和其他
-func downloadFile(ft FileTable, rc config.RegionConfig, fl FileLog) (string, string, error) {
+// CFLJ按前缀映射为本地/挂载路径 前缀不区分大小写和\/ 无匹配时返回false
+// 映射结果不能跳出挂载目录(CFLJ中含..) 否则返回永久错误
+func mountPath(cflj string, mounts []config.MountConfig) (string, bool, error) {
+	p := strings.ReplaceAll(cflj, "\\", "/")
+	for _, m := range mounts {
+		prefix := strings.ReplaceAll(m.Prefix, "\\", "/")
+		if len(prefix) == 0 || len(p) < len(prefix) || !strings.EqualFold(p[:len(prefix)], prefix) {
+			continue
+		}
+		root := path.Clean(strings.ReplaceAll(m.Path, "\\", "/"))
+		local := path.Join(root, p[len(prefix):])
+		if local != root && !strings.HasPrefix(local, strings.TrimSuffix(root, "/")+"/") {
+			return "", true, &util.ValidationError{Reason: "路径跳出挂载目录 " + cflj}
+		}
+		return local, true, nil
+	}
+	return "", false, nil
+}
 
-	if rc.Name == "xj" {
-		downloadUrl, err := getFileDownloadUrlXj(ft, rc)
+func ftpOptions(fc config.FtpConfig) util.FTPOptions {
+	return util.FTPOptions{
+		Username:           fc.Username,
+		Password:           fc.Password,
+		ExplicitTLS:        fc.ExplicitTLS,
+		InsecureSkipVerify: fc.InsecureSkipVerify,
+		Timeout:            fc.Timeout,
+	}
+}
+
+func sftpOptions(sc config.SftpConfig) util.SFTPOptions {
+	return util.SFTPOptions{
+		Username:       sc.Username,
+		Password:       sc.Password,
+		PrivateKeyFile: sc.PrivateKeyFile,
+		Passphrase:     sc.Passphrase,
+		KnownHostsFile: sc.KnownHostsFile,
+		InsecureHost:   sc.InsecureHost,
+		Timeout:        sc.Timeout,
+	}
+}
+
+// 目标落盘存储 target.sftp.addr配置时落盘到SFTP服务器 否则为本地磁盘
+func InitTargetStore(c config.Config) {
+	if len(c.Target.Sftp.Addr) == 0 {
+		return
+	}
+
+	store, err := util.NewSFTPStore(c.Target.Sftp.Addr, sftpOptions(c.Target.Sftp))
+	if err != nil {
+		logger.Fatalln("target sftp init error: " + err.Error())
+	}
+	util.FS = store
+}
+
+// 下载具体静态文件落盘 分新疆和其他 staged时下载到暂存地址 由调用方替换旧文件
+func downloadFile(ctx context.Context, ft FileRow, rc config.RegionConfig, job config.SyncJob, fl FileLog, staged bool) (f fetchedFile, err error) {
+	ctx, span := startSpan(ctx, "downloadFile", rc.Name, &fl)
+	defer func() {
+		span.SetAttributes(attribute.String("http.url", f.url), attribute.String("file.store_path", f.storePath))
+		endSpan(span, err)
+	}()
+
+	f.url, err = getSourceUrl(ft, rc, job)
+	if err != nil {
+		return f, err
+	}
+
+	f.storePath = getFileStorePath(ft.Str(job.PathColumn), rc, job, fl) // 目标服务器文件落盘地址
+	f.path = f.storePath
+	if staged {
+		f.path = f.storePath + ".new"
+	}
+	ext := fileExt(ft, job)
+	if err = checkExtension(rc.Validation, ext); err != nil {
+		return f, err
+	}
+	client, err := agentClient(rc)
+	if err != nil {
+		return f, err
+	}
+	opts := util.DownloadOptions{
+		Client:           client,
+		ProgressInterval: cfg.ProgressInterval,
+		OnProgress:       downloadProgress(rc),
+		MaxSize:          rc.Validation.MaxSize,
+		Segments:         rc.Segment.Parts,
+		SegmentThreshold: rc.Segment.Threshold,
+		Validate:         contentValidator(ext),
+	}
+
+	// 已落盘且大小与上次一致时使用条件下载 源文件未变化则跳过 暂存下载总是完整下载
+	if !staged {
+		meta, found, err := loadFileMeta(ctx, f.storePath)
 		if err != nil {
-			return "", "", err
+			logger.Printf("%s loadFileMeta error:%s\r\n", rc.Name, err.Error())
 		}
+		if local, serr := util.FS.Stat(f.storePath); found && serr == nil && local.Size() == meta.Size {
+			opts.IfNoneMatch = meta.ETag
+			opts.IfModifiedSince = meta.LastModified
+		}
+	}
 
-		storePath := getFileStorePath(ft, rc, fl) // 目标服务器文件落盘地址
-		err = util.DownloadFile(storePath, downloadUrl)
-		return downloadUrl, storePath, err
+	if util.IsFTPUrl(f.url) {
+		f.result, err = util.DownloadFTP(ctx, f.path, f.url, ftpOptions(rc.Ftp), opts)
+	} else if util.IsSFTPUrl(f.url) {
+		f.result, err = util.DownloadSFTP(ctx, f.path, f.url, sftpOptions(rc.Sftp), opts)
+	} else if util.IsFileUrl(f.url) {
+		f.result, err = util.DownloadLocal(ctx, f.path, f.url, opts)
 	} else {
-		downloadUrl := getFileDownloadUrl(ft, rc) // 源服务器文件下载地址
-		storePath := getFileStorePath(ft, rc, fl) // 目标服务器文件落盘地址
-		err := util.DownloadFile(storePath, downloadUrl)
-		return downloadUrl, storePath, err
+		f.result, err = util.Download(ctx, f.path, f.url, opts)
+	}
+	if err != nil {
+		return f, err
+	}
+	if f.result.NotModified {
+		logger.Printf("%s 源文件未变化 跳过下载:%s\r\n", rc.Name, f.storePath)
+		return f, nil
 	}
 
-	return "", "", nil
+	if !staged {
+		if err = saveFileMeta(ctx, f.storePath, f.result); err != nil {
+			logger.Printf("%s saveFileMeta error:%s\r\n", rc.Name, err.Error())
+		}
+	}
+	return f, nil
+}
+
+// 一次下载的结果
+type fetchedFile struct {
+	url       string // 源服务器文件下载地址
+	storePath string // 目标服务器文件落盘地址
+	path      string // 实际写入的地址 暂存下载时为storePath+".new" 替换旧文件后再改名
+	result    util.DownloadResult
+}
+
+// 源服务器文件下载地址 分新疆和其他 推送模式为agent已上传的文件
+func getSourceUrl(ft FileRow, rc config.RegionConfig, job config.SyncJob) (string, error) {
+	if rc.Push {
+		return util.FileUrl(pushFilePath(rc.Name, ft.Str(job.PathColumn))), nil
+	}
+	if util.IsFTPUrl(ft.Str(job.PathColumn)) || util.IsSFTPUrl(ft.Str(job.PathColumn)) {
+		return ft.Str(job.PathColumn), nil
+	}
+	if p, ok, err := mountPath(ft.Str(job.PathColumn), rc.Mounts); err != nil {
+		return "", err
+	} else if ok {
+		return util.FileUrl(p), nil
+	}
+	if len(rc.Agent.Url) > 0 {
+		return agentUrl(ft.Str(job.PathColumn), rc.Agent), nil
+	}
+	if rc.Name == "xj" {
+		return getFileDownloadUrlXj(ft.Str(job.PathColumn), rc)
+	}
+	return getFileDownloadUrl(ft.Str(job.PathColumn), rc), nil
+}
+
+// U是否仅修改了元数据: 新的落盘地址与目标库记录一致 且源文件大小(及ETag)与已落盘文件相同
+func isMetadataOnlyUpdate(ctx context.Context, ft FileRow, ftt FileRow, rc config.RegionConfig, job config.SyncJob, fl FileLog) bool {
+	storePath := getFileStorePath(ft.Str(job.PathColumn), rc, job, fl)
+	if getFileFTPPath(storePath) != ftt.Str(job.PathColumn) {
+		return false
+	}
+
+	local, err := util.FS.Stat(storePath)
+	if err != nil {
+		return false
+	}
+
+	downloadUrl, err := getSourceUrl(ft, rc, job)
+	if err != nil {
+		return false
+	}
+	var remote util.RemoteInfo
+	if util.IsFTPUrl(downloadUrl) {
+		remote, err = util.StatFTP(ctx, downloadUrl, ftpOptions(rc.Ftp))
+	} else if util.IsSFTPUrl(downloadUrl) {
+		remote, err = util.StatSFTP(ctx, downloadUrl, sftpOptions(rc.Sftp))
+	} else {
+		var client *http.Client
+		if client, err = agentClient(rc); err != nil {
+			return false
+		}
+		remote, err = util.StatRemote(ctx, downloadUrl, client)
+	}
+	if err != nil {
+		logger.Printf("%s StatRemote[updateFile] error:%s\r\n", rc.Name, err.Error())
+		return false
+	}
+	if remote.Size < 0 || remote.Size != local.Size() {
+		return false
+	}
+	// 有上次下载记录的ETag时 ETag也须一致 无ETag(FTP/SFTP)时比较修改时间
+	meta, found, err := loadFileMeta(ctx, storePath)
+	if err == nil && found && len(meta.ETag) > 0 && len(remote.ETag) > 0 && meta.ETag != remote.ETag {
+		return false
+	}
+	if err == nil && found && len(meta.ETag) == 0 && len(meta.LastModified) > 0 && len(remote.LastModified) > 0 && meta.LastModified != remote.LastModified {
+		return false
+	}
+
+	logger.Printf("%s 文件未变化 仅更新元数据:%s\r\n", rc.Name, storePath)
+	return true
 }
 
 // 拼接origin 文件下载地址
-func getFileDownloadUrl(ft FileTable, rc config.RegionConfig) string {
+func getFileDownloadUrl(cflj string, rc config.RegionConfig) string {
 	// 源头服务器文件下载地址 == BaseUrl + 截取RootDir之后的剩余path
 	restPath := ""
-	strlist := strings.Split(ft.CFLJ, rc.RootDir)
+	strlist := strings.Split(cflj, rc.RootDir)
 	if len(strlist) == 2 {
 		restPath = strlist[1]
 		u, err := url.JoinPath(rc.BaseUrl, strings.ReplaceAll(restPath, "\\", "/"))
@@ -426,15 +1116,18 @@ func getFileDownloadUrl(ft FileTable, rc config.RegionConfig) string {
 }
 
 // 拼接origin 文件下载地址 新疆油田特殊实现
-func getFileDownloadUrlXj(ft FileTable, rc config.RegionConfig) (string, error) {
+func getFileDownloadUrlXj(cflj string, rc config.RegionConfig) (string, error) {
 	// 解析新疆文件url
-	u, err := url.Parse(ft.CFLJ)
+	u, err := url.Parse(cflj)
 	if err != nil {
 		logger.Println("getFileDownloadUrlXj error: " + err.Error())
 		return "", err
 	}
+	if u.Scheme == "ftp" || u.Scheme == "ftps" {
+		return cflj, nil // FTP文件直接从FTP服务器下载
+	}
 	if u.Scheme != "http" {
-		err = errors.New("新疆非http文件不做处理")
+		err = errors.New("新疆非http/ftp文件不做处理")
 		return "", err
 	}
 
@@ -459,17 +1152,26 @@ func getFileDownloadUrlXj(ft FileTable, rc config.RegionConfig) (string, error)
 }
 
 // 新疆登录接口func 返回token 和 error
-func loginXj(rc config.RegionConfig) (string, error) {
+func loginXj(ctx context.Context, rc config.RegionConfig) (token string, err error) {
 	if rc.Name != "xj" {
 		return "", nil
 	}
 
+	ctx, span := startSpan(ctx, "loginXj", rc.Name, nil)
+	defer func() { endSpan(span, err) }()
+	span.SetAttributes(attribute.String("http.url", rc.LoginUrl))
+
 	data := url.Values{}
 	data.Set("grant_type", rc.GrantType)
 	data.Set("client_id", rc.ClientId)
 	data.Set("client_secret", rc.ClientSecret)
 
-	response, err := http.Post(rc.LoginUrl, "application/x-www-form-urlencoded", bytes.NewBufferString(data.Encode()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rc.LoginUrl, bytes.NewBufferString(data.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response, err := http.DefaultClient.Do(req)
 	if err != nil {
 		fmt.Println("请求错误:", err)
 		return "", nil
@@ -492,11 +1194,25 @@ func loginXj(rc config.RegionConfig) (string, error) {
 }
 
 // 拼接target 文件落盘地址
-func getFileStorePath(ft FileTable, originRC config.RegionConfig, fl FileLog) string {
-	filename := path.Base(strings.ReplaceAll(ft.CFLJ, "\\", "/"))
-	// 目标服务器文件落盘地址 == RootDir + cnpc_dq + 井号第一个字 + 井号 + 文件名
-	p := path.Join(cfg.Target.RootDir, regionPrefix+originRC.Name, fl.JH[0:3], fl.JH, filename)
-	return p
+func getFileStorePath(cflj string, originRC config.RegionConfig, job config.SyncJob, fl FileLog) string {
+	filename := path.Base(strings.ReplaceAll(cflj, "\\", "/"))
+	regionDir := path.Join(cfg.Target.RootDir, regionPrefix+originRC.Name, job.StoreDir)
+
+	// 目标服务器文件落盘地址 == RootDir + cnpc_dq + [storeDir] + 井号第一个字 + 井号 + 文件名
+	if jh := fl.Key("JH"); len(jh) > 0 {
+		first := jh
+		if len(jh) >= 3 {
+			first = jh[0:3]
+		}
+		return path.Join(regionDir, first, jh, filename)
+	}
+
+	// 主键不含井号时 == RootDir + cnpc_dq + [storeDir] + 各主键值 + 文件名
+	p := regionDir
+	for _, kv := range fl.Keys {
+		p = path.Join(p, strings.ReplaceAll(kv.Value, "/", "_"))
+	}
+	return path.Join(p, filename)
 }
 
 // 拼接target 文件入库地址 ftp地址
@@ -513,39 +1229,98 @@ func getFileFTPPath(storePath string) string {
 }
 
 // 拼接target 文件入库地址(ftp地址)  转 文件落盘地址
+// 与getFileStorePath一致按/拼接 本地磁盘(含Windows)和SFTP服务器均可用
 func ftpToStorePath(ftpPath string) string {
 	restPath := ""
 	strlist := strings.Split(ftpPath, cfg.Target.FtpPrefix)
 	if len(strlist) == 2 {
 		restPath = strlist[1]
-		p := cfg.Target.RootDir + strings.ReplaceAll(restPath, "/", "\\")
-		return p
+		return path.Join(cfg.Target.RootDir, restPath)
 	}
 
 	return ""
 }
 
 type FileLog struct {
-	DW       string `db:"DW"`
-	JH       string `db:"JH"`
-	WDMC     string `db:"WDMC"`
-	SEQUENCE string `db:"SEQUENCE$$"`
-	DMLTYPE  string `db:"DMLTYPE$$"`
-}
-
-type FileTable struct {
-	DW   string    `db:"DW"`
-	JH   string    `db:"JH"`
-	WDMC string    `db:"WDMC"`
-	CFLJ string    `db:"CFLJ"`
-	WDLX string    `db:"WDLX"`
-	WDZY string    `db:"WDZY"`
-	SJLB string    `db:"SJLB"`
-	BXDW string    `db:"BXDW"`
-	BXRQ time.Time `db:"BXRQ"`
-	BZ   string    `db:"BZ"`
-	LRR  string    `db:"LRR"`
-	LRRQ time.Time `db:"LRRQ"`
+	Keys     []KeyValue // 主键列值 按同步表keyColumns顺序
+	SEQUENCE string
+	DMLTYPE  string
+}
+
+type KeyValue struct {
+	Column string
+	Value  string
+}
+
+// 由log表一行记录解析FileLog NULL列为空串
+func fileLogFromRow(row FileRow, keyColumns []string) FileLog {
+	fl := FileLog{
+		SEQUENCE: row.Str("SEQUENCE$$"),
+		DMLTYPE:  row.Str("DMLTYPE$$"),
+	}
+	for _, col := range keyColumns {
+		fl.Keys = append(fl.Keys, KeyValue{Column: col, Value: row.Str(col)})
+	}
+	return fl
+}
+
+// 主键列值 不存在时返回空串
+func (fl FileLog) Key(col string) string {
+	for _, kv := range fl.Keys {
+		if kv.Column == col {
+			return kv.Value
+		}
+	}
+	return ""
+}
+
+// 主键值拼接 用于日志输出
+func (fl FileLog) KeyString() string {
+	values := make([]string, 0, len(fl.Keys))
+	for _, kv := range fl.Keys {
+		values = append(values, kv.Value)
+	}
+	return strings.Join(values, "-")
+}
+
+// 主键值以\x00拼接 用于比对 主键值本身可能含- KeyString会混淆("a-b","c")与("a","b-c")
+func (fl FileLog) keyTuple() string {
+	values := make([]string, 0, len(fl.Keys))
+	for _, kv := range fl.Keys {
+		values = append(values, kv.Value)
+	}
+	return strings.Join(values, "\x00")
+}
+
+// 主键相同
+func (fl FileLog) SameKeys(o FileLog) bool {
+	if len(fl.Keys) != len(o.Keys) {
+		return false
+	}
+	for i := range fl.Keys {
+		if fl.Keys[i] != o.Keys[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// 主键查询条件 K1 =:K1 and K2 =:K2
+func (fl FileLog) keyWhere() string {
+	conds := make([]string, 0, len(fl.Keys))
+	for _, kv := range fl.Keys {
+		conds = append(conds, kv.Column+" =:"+kv.Column)
+	}
+	return strings.Join(conds, " and ")
+}
+
+// 主键命名参数
+func (fl FileLog) keyArgs() map[string]interface{} {
+	args := make(map[string]interface{}, len(fl.Keys))
+	for _, kv := range fl.Keys {
+		args[kv.Column] = kv.Value
+	}
+	return args
 }
 
 type LoginRespXJ struct {
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"io"
+	"log"
 	"testing"
+
+	"prospect_file_sync/config"
 )
 
 func Test_getFileDownloadUrlXj1(t *testing.T) {
 	type args struct {
-		ft FileTable
+		cflj string
 	}
 	tests := []struct {
 		name    string
@@ -17,29 +23,35 @@ func Test_getFileDownloadUrlXj1(t *testing.T) {
 		{
 			name: "a",
 			args: args{
-				ft: FileTable{
-					DW:   "xj",
-					CFLJ: "http://11.71.10.44:8060/wbwj/scyx/jw/FT/xx.jpg",
-				},
+				cflj: "http://11.71.10.44:8060/wbwj/scyx/jw/FT/xx.jpg",
 			},
-			want:    "https://wbwj.http://11.71.10.44:8060/scyx/jw/FT/xx.jpg",
+			want:    "http://api.iosp.xjyt.petrochina/download?access_token=&url=https%3A%2F%2Fwbwj.http%3A%2F%2F11.71.10.44%3A8060%2Fscyx%2Fjw%2FFT%2Fxx.jpg",
 			wantErr: false,
 		},
 		{
 			name: "b",
 			args: args{
-				ft: FileTable{
-					DW:   "xj",
-					CFLJ: "ftp://11.71.10.44:8060/wbwj/scyx/jw/FT/xx.jpg",
-				},
+				cflj: "ftp://11.71.10.44:8060/wbwj/scyx/jw/FT/xx.jpg",
+			},
+			want:    "ftp://11.71.10.44:8060/wbwj/scyx/jw/FT/xx.jpg",
+			wantErr: false,
+		},
+		{
+			name: "c",
+			args: args{
+				cflj: "smb://11.71.10.44/wbwj/scyx/jw/FT/xx.jpg",
 			},
 			want:    "",
 			wantErr: true,
 		},
 	}
+	rc := config.RegionConfig{
+		Name:            "xj",
+		FileDownloadUrl: "http://api.iosp.xjyt.petrochina/download",
+	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := getFileDownloadUrlXj(tt.args.ft)
+			got, err := getFileDownloadUrlXj(tt.args.cflj, rc)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("getFileDownloadUrlXj() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -50,3 +62,81 @@ func Test_getFileDownloadUrlXj1(t *testing.T) {
 		})
 	}
 }
+
+func Test_mountPath(t *testing.T) {
+	mounts := []config.MountConfig{
+		{Prefix: `D:\KTXXWD\`, Path: "/mnt/ktxxwd/"},
+		{Prefix: "E:/docs/", Path: "/mnt/docs"},
+	}
+	tests := []struct {
+		cflj   string
+		want   string
+		wantOk bool
+	}{
+		{`D:\KTXXWD\dq\X1\a.pdf`, "/mnt/ktxxwd/dq/X1/a.pdf", true},
+		{`d:/ktxxwd/dq/a.pdf`, "/mnt/ktxxwd/dq/a.pdf", true},
+		{`E:\docs\b.doc`, "/mnt/docs/b.doc", true},
+		{`F:\other\c.pdf`, "", false},
+	}
+	for _, tt := range tests {
+		got, ok, err := mountPath(tt.cflj, mounts)
+		if got != tt.want || ok != tt.wantOk || err != nil {
+			t.Errorf("mountPath(%s) = %v, %v, %v, want %v, %v", tt.cflj, got, ok, err, tt.want, tt.wantOk)
+		}
+	}
+
+	// ..跳出挂载目录 永久错误
+	if _, _, err := mountPath(`D:\KTXXWD\..\..\etc\passwd`, mounts); !isPermanentError(err) {
+		t.Errorf("mountPath() error = %v, want permanent error", err)
+	}
+}
+
+// 源头库记录已删除的源头库 记录推进到的log
+type missingOrigin struct {
+	consumed []string
+}
+
+func (o *missingOrigin) queryFile(ctx context.Context, job config.SyncJob, cols []config.ColumnMapping, fl FileLog) (FileRow, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (o *missingOrigin) deleteLog(ctx context.Context, job config.SyncJob, fl FileLog) error {
+	o.consumed = append(o.consumed, fl.SEQUENCE)
+	return nil
+}
+
+// 检查点模式下I之后源头库记录被删除 I跳过并推进检查点 不阻塞其后的log
+func Test_syncLog_rowDeleted(t *testing.T) {
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	rc := config.RegionConfig{Name: "dq", Consume: consumeCheckpoint}
+	job := config.SyncJob{Name: "a", FileTable: "A", TargetTable: "A", PathColumn: "CFLJ", KeyColumns: []string{"WDMC"}}
+	fl := FileLog{Keys: []KeyValue{{Column: "WDMC", Value: "a.pdf"}}, SEQUENCE: "1", DMLTYPE: "I"}
+
+	o := &missingOrigin{}
+	if err := syncLog(context.Background(), o, rc, job, fl); err != nil {
+		t.Fatalf("syncLog() error = %v, want nil", err)
+	}
+	if len(o.consumed) != 1 || o.consumed[0] != "1" {
+		t.Errorf("consumed = %v, want [1]", o.consumed)
+	}
+}
+
+// 落盘地址与入库ftp地址互转 SFTP落盘(POSIX路径)时不能拼出\分隔的路径
+func Test_ftpToStorePath(t *testing.T) {
+	old := cfg.Target
+	defer func() { cfg.Target = old }()
+	cfg.Target.RootDir = "/data/files"
+	cfg.Target.FtpPrefix = "ftp://10.0.0.1/files"
+
+	fl := FileLog{Keys: []KeyValue{{Column: "JH", Value: "X1-2"}, {Column: "WDMC", Value: "a.pdf"}}}
+	storePath := getFileStorePath(`D:\docs\a.pdf`, config.RegionConfig{Name: "dq"}, config.SyncJob{}, fl)
+	ftpPath := getFileFTPPath(storePath)
+	if want := "ftp://10.0.0.1/files/cnpc_dq/X1-/X1-2/a.pdf"; ftpPath != want {
+		t.Errorf("getFileFTPPath() = %s, want %s", ftpPath, want)
+	}
+	if got := ftpToStorePath(ftpPath); got != storePath {
+		t.Errorf("ftpToStorePath() = %s, want %s", got, storePath)
+	}
+}
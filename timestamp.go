@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"prospect_file_sync/config"
+)
+
+// 时间戳增量同步: 源头库无物化视图日志时 按修改时间列轮询源头文件表
+// 目标库记录各油田各同步表已同步到的修改时间(水位线) 每次查询 修改时间 > 水位线-重叠窗口 的记录按U同步(目标库无记录时转I)
+// 修改时间列无法发现删除 按diffInterval定期比对源头表与目标表(本油田落盘目录下的记录)的主键 目标表多出的按D同步
+// 修改时间为空的记录 修改时间 > 水位线 查询不到 由主键比对发现目标表中没有的按U同步 已同步的之后的修改无法发现
+// 注意: 同一油田多个同步表共用目标表时需配置不同的storeDir 否则主键比对会误删其他同步表的记录
+
+const (
+	defaultWatermarkTable = "SYNC_WATERMARK"
+	defaultOverlap        = 10 * time.Minute
+)
+
+// 水位线 Mark为已同步的最大修改时间 LastDiff为上次完成主键比对的时间
+type watermark struct {
+	Region    string       `db:"REGION" json:"region"`
+	Job       string       `db:"JOB" json:"job"`
+	Mark      sql.NullTime `db:"MARK" json:"mark"`
+	LastDiff  sql.NullTime `db:"LAST_DIFF" json:"lastDiff"`
+	UpdatedAt sql.NullTime `db:"UPDATED_AT" json:"updatedAt"`
+}
+
+func isTimestampJob(job config.SyncJob) bool {
+	return len(job.Timestamp.Column) > 0
+}
+
+func watermarkTable() string {
+	if len(cfg.Target.DB.WatermarkTable) > 0 {
+		return cfg.Target.DB.WatermarkTable
+	}
+	return defaultWatermarkTable
+}
+
+func timestampOverlap(job config.SyncJob) time.Duration {
+	if job.Timestamp.Overlap > 0 {
+		return job.Timestamp.Overlap
+	}
+	return defaultOverlap
+}
+
+// 未配置主键比对时 修改时间为空的记录首次同步之后不会再同步 启动时提示
+func warnNullTimestamps() {
+	for _, rc := range cfg.Regions {
+		for _, job := range regionJobs(rc) {
+			if isTimestampJob(job) && job.Timestamp.DiffInterval <= 0 {
+				logger.Printf("%s[%s] 警告: 未配置timestamp.diffInterval %s为空的记录首次同步之后不会再同步 也无法发现删除\r\n", rc.Name, job.Name, job.Timestamp.Column)
+			}
+		}
+	}
+}
+
+// 初始化目标库的水位线表
+func ensureWatermarkTable() error {
+	return ensureTable(fmt.Sprintf(`CREATE TABLE "%s" (
+		REGION VARCHAR2(100),
+		JOB VARCHAR2(100),
+		MARK TIMESTAMP,
+		LAST_DIFF DATE,
+		UPDATED_AT DATE,
+		PRIMARY KEY (REGION, JOB)
+	)`, watermarkTable()))
+}
+
+// 查询水位线 无记录时Mark/LastDiff无效 从头同步
+func loadWatermark(ctx context.Context, region string, job string) (watermark, error) {
+	wm := watermark{Region: region, Job: job}
+	sqlStr := fmt.Sprintf(`SELECT REGION, JOB, MARK, LAST_DIFF, UPDATED_AT FROM "%s" WHERE REGION = :1 AND JOB = :2`, watermarkTable())
+	err := targetDB.GetContext(ctx, &wm, sqlStr, region, job)
+	if errors.Is(err, sql.ErrNoRows) {
+		return wm, nil
+	}
+	return wm, err
+}
+
+func saveWatermark(ctx context.Context, wm watermark) (err error) {
+	ctx, span := startDBSpan(ctx, "saveWatermark", wm.Job)
+	defer func() { endSpan(span, err) }()
+
+	sqlStr := fmt.Sprintf(`MERGE INTO "%s" w USING (SELECT :1 REGION, :2 JOB FROM dual) s
+		ON (w.REGION = s.REGION AND w.JOB = s.JOB)
+		WHEN MATCHED THEN UPDATE SET w.MARK = :3, w.LAST_DIFF = :4, w.UPDATED_AT = SYSDATE
+		WHEN NOT MATCHED THEN INSERT (REGION, JOB, MARK, LAST_DIFF, UPDATED_AT) VALUES (:5, :6, :7, :8, SYSDATE)`, watermarkTable())
+	_, err = targetDB.ExecContext(ctx, sqlStr, wm.Region, wm.Job, wm.Mark, wm.LastDiff, wm.Region, wm.Job, wm.Mark, wm.LastDiff)
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("%s[%s] watermark = %s\r\n", wm.Region, wm.Job, wm.Mark.Time.Format(time.RFC3339))
+	return nil
+}
+
+// 本次同步的各同步表水位线进度
+type watermarkRun map[string]*watermarkProgress
+
+type watermarkProgress struct {
+	stored  watermark
+	mark    time.Time // 已同步成功的最大修改时间
+	stopped bool      // 遇到失败的记录 水位线停在其之前
+	diffed  bool      // 本次做了主键比对
+	held    bool      // 主键比对发现的删除未全部完成 下次重新比对
+}
+
+// 查询时间戳同步表的待同步记录 到期时附加主键比对得到的D记录
+func (w watermarkRun) load(ctx context.Context, originDB *sqlx.DB, rc config.RegionConfig, job config.SyncJob) ([]jobLog, error) {
+	if len(job.FileTable) == 0 || len(job.TargetTable) == 0 {
+		return nil, errors.New("fileTable or targetTable is null")
+	}
+	wm, err := loadWatermark(ctx, rc.Name, job.Name)
+	if err != nil {
+		return nil, err
+	}
+	p := &watermarkProgress{stored: wm, mark: wm.Mark.Time}
+	w[job.Name] = p
+
+	rows, err := queryChangedFiles(ctx, originDB, job, wm)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := make([]jobLog, 0)
+	for rows.Next() {
+		row, err := scanFileRow(rows)
+		if err != nil {
+			logger.Printf("%s scanFileRow error:%s\r\n", rc.Name, err.Error())
+			continue
+		}
+		fl := fileLogFromRow(row, job.KeyColumns)
+		fl.DMLTYPE = "U"
+		ts, _ := row["SYNC_TS$$"].(time.Time)
+		tasks = append(tasks, jobLog{job: job, fl: fl, ts: ts})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	diff := job.Timestamp.DiffInterval
+	if diff > 0 && (!wm.LastDiff.Valid || time.Since(wm.LastDiff.Time) >= diff) {
+		deletes, missing, err := diffKeys(ctx, originDB, rc, job)
+		if err != nil {
+			return nil, err
+		}
+		logger.Printf("%s[%s] 主键比对 %d 条源头库已删除 %d 条修改时间为空未同步\r\n", rc.Name, job.Name, len(deletes), len(missing))
+		tasks = append(tasks, missing...)
+		tasks = append(tasks, deletes...)
+		p.diffed = true
+	}
+	return tasks, nil
+}
+
+// 查询修改时间 > 水位线-重叠窗口 的记录 无水位线时查询全部 有水位线后修改时间为空的记录查询不到 由diffKeys补充
+func queryChangedFiles(ctx context.Context, db *sqlx.DB, job config.SyncJob, wm watermark) (*sqlx.Rows, error) {
+	ctx, span := startDBSpan(ctx, "queryChangedFiles", job.FileTable)
+	defer span.End()
+
+	col := job.Timestamp.Column
+	sqlStr := fmt.Sprintf(`SELECT %s, %s AS SYNC_TS$$ FROM "%s"`, strings.Join(job.KeyColumns, ","), col, job.FileTable)
+	args := []interface{}{}
+	if wm.Mark.Valid {
+		sqlStr += fmt.Sprintf(" WHERE %s > :1", col)
+		args = append(args, wm.Mark.Time.Add(-timestampOverlap(job)))
+	}
+	sqlStr += fmt.Sprintf(" ORDER BY %s", col)
+	return db.QueryxContext(ctx, sqlStr, args...)
+}
+
+// 比对源头表与目标表的主键 deletes为目标表中本油田落盘目录下源头库已不存在的记录(D)
+// missing为修改时间为空且目标表中没有的源头库记录(U 目标库无记录时转I) 修改时间为空的记录查询不到 只能由比对发现
+// 按主键值元组比对 源头库主键同时按原值和当前列转换后的值记录 修改主键列的转换不会使目标表的记录全部被判为已删除
+func diffKeys(ctx context.Context, originDB *sqlx.DB, rc config.RegionConfig, job config.SyncJob) (deletes []jobLog, missing []jobLog, err error) {
+	ctx, span := startDBSpan(ctx, "diffKeys", job.TargetTable)
+	defer func() { endSpan(span, err) }()
+
+	keys := strings.Join(job.KeyColumns, ",")
+	keyCols := keyColumnMappings(job)
+	origin := map[string]bool{}
+	type nullRow struct {
+		fl     FileLog
+		tuples []string
+	}
+	nulls := make([]nullRow, 0)
+	sqlStr := fmt.Sprintf(`SELECT %s, CASE WHEN %s IS NULL THEN 1 ELSE 0 END AS SYNC_NULL$$ FROM "%s"`, keys, job.Timestamp.Column, job.FileTable)
+	rows, err := originDB.QueryxContext(ctx, sqlStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		row, err := scanFileRow(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		fl := fileLogFromRow(row, job.KeyColumns)
+		tuples := []string{fl.keyTuple()}
+		if len(keyCols) > 0 {
+			if err = applyTransforms(row, keyCols); err != nil {
+				return nil, nil, err
+			}
+			tuples = append(tuples, fileLogFromRow(row, job.KeyColumns).keyTuple())
+		}
+		for _, k := range tuples {
+			origin[k] = true
+		}
+		if row.Str("SYNC_NULL$$") == "1" {
+			fl.DMLTYPE = "U"
+			nulls = append(nulls, nullRow{fl: fl, tuples: tuples})
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	dirLike, err := jobPathLike(rc, job)
+	if err != nil {
+		return nil, nil, err
+	}
+	target := map[string]bool{}
+	sqlStr = fmt.Sprintf(`SELECT %s FROM "%s" WHERE %s LIKE :1 ESCAPE '\'`, keys, job.TargetTable, job.PathColumn)
+	trows, err := targetDB.QueryxContext(ctx, sqlStr, dirLike)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer trows.Close()
+	for trows.Next() {
+		row, err := scanFileRow(trows)
+		if err != nil {
+			return nil, nil, err
+		}
+		fl := fileLogFromRow(row, job.KeyColumns)
+		target[fl.keyTuple()] = true
+		if !origin[fl.keyTuple()] {
+			fl.DMLTYPE = "D"
+			deletes = append(deletes, jobLog{job: job, fl: fl})
+		}
+	}
+	if err = trows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	for _, n := range nulls {
+		synced := false
+		for _, k := range n.tuples {
+			synced = synced || target[k]
+		}
+		if !synced {
+			missing = append(missing, jobLog{job: job, fl: n.fl})
+		}
+	}
+	return deletes, missing, nil
+}
+
+// 主键列中配置了转换的列映射
+func keyColumnMappings(job config.SyncJob) []config.ColumnMapping {
+	isKey := map[string]bool{}
+	for _, k := range job.KeyColumns {
+		isKey[strings.ToUpper(k)] = true
+	}
+	list := make([]config.ColumnMapping, 0)
+	for _, c := range jobColumns(job) {
+		if isKey[c.Target] && len(c.Transform) > 0 {
+			list = append(list, c)
+		}
+	}
+	return list
+}
+
+// LIKE中的\ % _转义 配合ESCAPE '\'
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// 批量删除被拦截 本次比对的删除未执行 下次重新比对
+func (w watermarkRun) holdDeletes() {
+	for _, p := range w {
+		p.held = true
+	}
+}
+
+// 记录一条时间戳记录的同步结果 水位线推进到第一条失败记录之前 永久失败不阻塞
+func (w watermarkRun) done(t jobLog, err error) {
+	p, ok := w[t.job.Name]
+	if !ok {
+		return
+	}
+	failed := err != nil && !isPermanentError(err)
+	if t.fl.DMLTYPE == "D" {
+		if failed {
+			p.held = true
+		}
+		return
+	}
+	if failed {
+		p.stopped = true
+	}
+	if !p.stopped && t.ts.After(p.mark) {
+		p.mark = t.ts
+	}
+}
+
+// 保存各同步表的水位线 比对的删除全部完成时记录比对时间
+func (w watermarkRun) save(ctx context.Context) {
+	for _, p := range w {
+		wm := p.stored
+		changed := false
+		if !p.mark.IsZero() && (!wm.Mark.Valid || p.mark.After(wm.Mark.Time)) {
+			wm.Mark = sql.NullTime{Time: p.mark, Valid: true}
+			changed = true
+		}
+		if p.diffed && !p.held {
+			wm.LastDiff = sql.NullTime{Time: time.Now(), Valid: true}
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+		if err := saveWatermark(ctx, wm); err != nil {
+			logger.Printf("%s saveWatermark error:%s\r\n", wm.Region, err.Error())
+		}
+	}
+}
+
+// 修改时间 > 水位线-重叠窗口 的记录数 不含修改时间为空的记录
+func pendingTimestampCount(ctx context.Context, originDB *sqlx.DB, rc config.RegionConfig, job config.SyncJob) (int, error) {
+	wm, err := loadWatermark(ctx, rc.Name, job.Name)
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	if wm.Mark.Valid {
+		err = originDB.GetContext(ctx, &count, fmt.Sprintf(`SELECT COUNT(*) FROM "%s" WHERE %s > :1`, job.FileTable, job.Timestamp.Column), wm.Mark.Time.Add(-timestampOverlap(job)))
+	} else {
+		err = originDB.GetContext(ctx, &count, fmt.Sprintf(`SELECT COUNT(*) FROM "%s"`, job.FileTable))
+	}
+	return count, err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"prospect_file_sync/config"
+	"prospect_file_sync/util"
+)
+
+func Test_watermarkRun_done(t *testing.T) {
+	job := config.SyncJob{Name: "a", Timestamp: config.TimestampConfig{Column: "LRRQ"}}
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	w := watermarkRun{"a": &watermarkProgress{mark: base, diffed: true}}
+
+	w.done(jobLog{job: job, fl: FileLog{DMLTYPE: "U"}, ts: base.Add(time.Hour)}, nil)
+	w.done(jobLog{job: job, fl: FileLog{DMLTYPE: "U"}, ts: base.Add(2 * time.Hour)}, &util.ValidationError{Reason: "html"})
+	w.done(jobLog{job: job, fl: FileLog{DMLTYPE: "U"}, ts: base.Add(3 * time.Hour)}, errors.New("timeout"))
+	w.done(jobLog{job: job, fl: FileLog{DMLTYPE: "U"}, ts: base.Add(4 * time.Hour)}, nil)
+	w.done(jobLog{job: job, fl: FileLog{DMLTYPE: "D"}}, errors.New("timeout"))
+
+	p := w["a"]
+	if want := base.Add(2 * time.Hour); !p.mark.Equal(want) {
+		t.Errorf("mark = %v, want %v", p.mark, want)
+	}
+	if !p.held {
+		t.Error("held = false, want true after failed delete")
+	}
+}
+
+func Test_escapeLike(t *testing.T) {
+	got := escapeLike(`FTP://h/KTXXWD/cnpc_dq/a%b\c`)
+	if want := `FTP://h/KTXXWD/cnpc\_dq/a\%b\\c`; got != want {
+		t.Errorf("escapeLike() = %s, want %s", got, want)
+	}
+}
+
+// 主键比对按元组 主键值含-时不能混淆
+func TestFileLog_keyTuple(t *testing.T) {
+	a := FileLog{Keys: []KeyValue{{Column: "DW", Value: "a-b"}, {Column: "JH", Value: "c"}}}
+	b := FileLog{Keys: []KeyValue{{Column: "DW", Value: "a"}, {Column: "JH", Value: "b-c"}}}
+	if a.KeyString() != b.KeyString() {
+		t.Fatalf("KeyString() = %s, %s", a.KeyString(), b.KeyString())
+	}
+	if a.keyTuple() == b.keyTuple() {
+		t.Errorf("keyTuple() = %q for both", a.keyTuple())
+	}
+}
+
+func Test_keyColumnMappings(t *testing.T) {
+	job := config.SyncJob{KeyColumns: []string{"DW", "JH"}, Columns: []config.ColumnMapping{
+		{Source: "dw", Transform: "upper"},
+		{Source: "jh"},
+		{Source: "wdmc", Transform: "trim"},
+	}}
+	got := keyColumnMappings(job)
+	if len(got) != 1 || got[0].Target != "DW" {
+		t.Errorf("keyColumnMappings() = %+v, want only DW", got)
+	}
+}
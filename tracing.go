@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"prospect_file_sync/config"
+)
+
+var tracer = otel.Tracer("prospect_file_sync")
+
+// 初始化链路追踪 exporter为空时不导出 返回关闭函数 关闭时导出未发送的span
+func initTracing(tc config.TracingConfig) func(ctx context.Context) {
+	var exporter sdktrace.SpanExporter
+	var f *os.File
+	var err error
+	switch tc.Exporter {
+	case "":
+		return func(ctx context.Context) {}
+	case "otlp":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(tc.Endpoint)}
+		if tc.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case "file":
+		f, err = os.OpenFile(tc.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err == nil {
+			exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+		}
+	default:
+		logger.Fatalf("tracing.exporter error:%s is not in ['otlp','file']\r\n", tc.Exporter)
+	}
+	if err != nil {
+		logger.Fatalln("tracing init error: " + err.Error())
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName(tc.ServiceName))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return func(ctx context.Context) {
+		if err := tp.Shutdown(ctx); err != nil {
+			logger.Printf("tracing shutdown error:%s\r\n", err.Error())
+		}
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+// 开始一个span 附带油田和文件主键属性
+func startSpan(ctx context.Context, name string, region string, fl *FileLog) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{attribute.String("region", region)}
+	if fl != nil {
+		for _, kv := range fl.Keys {
+			attrs = append(attrs, attribute.String("file.key."+strings.ToLower(kv.Column), kv.Value))
+		}
+		attrs = append(attrs,
+			attribute.String("log.sequence", fl.SEQUENCE),
+			attribute.String("log.dmltype", fl.DMLTYPE),
+		)
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// 开始一个数据库操作span
+func startDBSpan(ctx context.Context, name string, table string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attribute.String("db.table", table)))
+}
+
+// 结束span 有错误时记录
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
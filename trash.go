@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"prospect_file_sync/config"
+	"prospect_file_sync/util"
+)
+
+const defaultTrashTable = "SYNC_TRASH"
+
+// 回收站记录 D删除/U被新版本替换
+type trashItem struct {
+	ID           string    `db:"ID" json:"id"`
+	Region       string    `db:"REGION" json:"region"`
+	Job          string    `db:"JOB" json:"job"`
+	TargetTable  string    `db:"TARGET_TABLE" json:"targetTable"`
+	Keys         string    `db:"KEYS" json:"keys"` // FileLog.Keys的JSON
+	OriginalPath string    `db:"ORIGINAL_PATH" json:"originalPath"`
+	TrashPath    string    `db:"TRASH_PATH" json:"trashPath"`
+	RowData      string    `db:"ROW_DATA" json:"-"` // 目标库记录 encodeRow的结果
+	Reason       string    `db:"REASON" json:"reason"`
+	DeletedAt    time.Time `db:"DELETED_AT" json:"deletedAt"`
+}
+
+func trashTable() string {
+	if len(cfg.Trash.Table) > 0 {
+		return cfg.Trash.Table
+	}
+	return defaultTrashTable
+}
+
+// 初始化目标库的回收站表
+func ensureTrashTable() error {
+	return ensureTable(fmt.Sprintf(`CREATE TABLE "%s" (
+		ID VARCHAR2(40) PRIMARY KEY,
+		REGION VARCHAR2(100),
+		JOB VARCHAR2(100),
+		TARGET_TABLE VARCHAR2(100),
+		KEYS VARCHAR2(2000),
+		ORIGINAL_PATH VARCHAR2(1000),
+		TRASH_PATH VARCHAR2(1000),
+		ROW_DATA CLOB,
+		REASON VARCHAR2(10),
+		DELETED_AT DATE
+	)`, trashTable()))
+}
+
+// 落盘文件移入回收站 并记录目标库记录以便恢复 代替直接删除文件
+func moveToTrash(ctx context.Context, rc config.RegionConfig, job config.SyncJob, fl FileLog, row FileRow, storePath string, reason string) (err error) {
+	ctx, span := startSpan(ctx, "moveToTrash", rc.Name, &fl)
+	defer func() { endSpan(span, err) }()
+
+	now := time.Now()
+	id := strconv.FormatInt(now.UnixNano(), 10)
+	trashPath := path.Join(cfg.Trash.Dir, now.Format("2006-01-02"), id+"_"+path.Base(metaKey(storePath)))
+
+	keys, err := json.Marshal(fl.Keys)
+	if err != nil {
+		return err
+	}
+	data, err := encodeRow(row)
+	if err != nil {
+		return err
+	}
+
+	if err = util.MoveFile(storePath, trashPath); err != nil {
+		return err
+	}
+
+	sqlStr := fmt.Sprintf(`INSERT INTO "%s" (ID, REGION, JOB, TARGET_TABLE, KEYS, ORIGINAL_PATH, TRASH_PATH, ROW_DATA, REASON, DELETED_AT)
+		VALUES (:1, :2, :3, :4, :5, :6, :7, :8, :9, :10)`, trashTable())
+	_, err = targetDB.ExecContext(ctx, sqlStr, id, rc.Name, job.Name, job.TargetTable, string(keys),
+		storePath, trashPath, data, reason, now)
+	if err != nil {
+		// 记录失败时文件移回原处 不留下无记录的回收站文件
+		if merr := util.MoveFile(trashPath, storePath); merr != nil {
+			logger.Printf("%s moveToTrash rollback error:%s\r\n", rc.Name, merr.Error())
+		}
+		return err
+	}
+
+	logger.Printf("%s moveToTrash:%s -> %s\r\n", rc.Name, storePath, trashPath)
+	return nil
+}
+
+// 查询回收站记录 按删除时间倒序
+func listTrash() ([]trashItem, error) {
+	list := []trashItem{}
+	sqlStr := fmt.Sprintf(`SELECT ID, REGION, JOB, TARGET_TABLE, KEYS, ORIGINAL_PATH, TRASH_PATH, REASON, DELETED_AT FROM "%s" ORDER BY DELETED_AT DESC`, trashTable())
+	err := targetDB.Select(&list, sqlStr)
+	return list, err
+}
+
+func getTrash(id string) (trashItem, error) {
+	var item trashItem
+	sqlStr := fmt.Sprintf(`SELECT ID, REGION, JOB, TARGET_TABLE, KEYS, ORIGINAL_PATH, TRASH_PATH, ROW_DATA, REASON, DELETED_AT FROM "%s" WHERE ID = :1`, trashTable())
+	err := targetDB.Get(&item, sqlStr, id)
+	return item, err
+}
+
+// 从回收站恢复 文件移回原路径 目标库记录替换为删除前的记录
+// 原路径已有文件(已同步了新版本)时不恢复
+func restoreTrash(id string) error {
+	item, err := getTrash(id)
+	if err != nil {
+		return err
+	}
+
+	if _, err = util.FS.Stat(item.OriginalPath); err == nil {
+		return errors.New("原路径已存在文件:" + item.OriginalPath)
+	}
+
+	fl := FileLog{}
+	if err = json.Unmarshal([]byte(item.Keys), &fl.Keys); err != nil {
+		return err
+	}
+	row, err := decodeRow(item.RowData)
+	if err != nil {
+		return err
+	}
+
+	if err = util.MoveFile(item.TrashPath, item.OriginalPath); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if err = deleteFileRecord(ctx, targetDB, fl, item.TargetTable); err != nil {
+		logger.Printf("%s deleteFileRecord[restoreTrash] error:%s\r\n", item.Region, err.Error())
+	}
+	if err = insertFileRecord(ctx, targetDB, row, rowColumns(row), item.TargetTable); err != nil {
+		util.MoveFile(item.OriginalPath, item.TrashPath)
+		return err
+	}
+
+	_, err = targetDB.Exec(fmt.Sprintf(`DELETE FROM "%s" WHERE ID = :1`, trashTable()), id)
+	if err != nil {
+		return err
+	}
+	logger.Printf("%s restoreTrash:%s -> %s\r\n", item.Region, item.TrashPath, item.OriginalPath)
+	return nil
+}
+
+// 清理超过保留期的回收站文件和记录
+func purgeTrash() {
+	if cfg.Trash.Retention <= 0 {
+		return
+	}
+
+	list := []trashItem{}
+	sqlStr := fmt.Sprintf(`SELECT ID, TRASH_PATH FROM "%s" WHERE DELETED_AT < :1`, trashTable())
+	err := targetDB.Select(&list, sqlStr, time.Now().Add(-cfg.Trash.Retention))
+	if err != nil {
+		logger.Printf("purgeTrash error:%s\r\n", err.Error())
+		return
+	}
+
+	for _, item := range list {
+		if err = util.DeleteFile(item.TrashPath); err != nil && !os.IsNotExist(err) {
+			logger.Printf("purgeTrash DeleteFile error:%s\r\n", err.Error())
+			continue
+		}
+		util.FS.Remove(path.Dir(item.TrashPath)) // 日期目录为空时一并删除
+
+		_, err = targetDB.Exec(fmt.Sprintf(`DELETE FROM "%s" WHERE ID = :1`, trashTable()), item.ID)
+		if err != nil {
+			logger.Printf("purgeTrash delete record error:%s\r\n", err.Error())
+			continue
+		}
+		logger.Printf("purgeTrash:%s\r\n", item.TrashPath)
+	}
+}
@@ -0,0 +1,252 @@
+package util
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// FTPOptions FTP/FTPS连接选项 url中带用户名密码时以url为准
+type FTPOptions struct {
+	Username           string
+	Password           string
+	ExplicitTLS        bool          // ftp://使用AUTH TLS ftps://总是隐式TLS
+	InsecureSkipVerify bool          // 不校验服务器证书
+	Timeout            time.Duration // 连接超时 缺省30s
+}
+
+// IsFTPUrl 是否为ftp://或ftps://地址
+func IsFTPUrl(rawurl string) bool {
+	lower := strings.ToLower(rawurl)
+	return strings.HasPrefix(lower, "ftp://") || strings.HasPrefix(lower, "ftps://")
+}
+
+// DownloadFTP 通过FTP/FTPS(被动模式)下载文件落盘
+// 先写入filepath.part 中断后再次下载时用REST从.part的大小处续传 完整后再替换目标文件
+// opts中的MaxSize/Validate/进度回调同Download 条件下载选项不适用
+func DownloadFTP(ctx context.Context, filepath string, rawurl string, fo FTPOptions, opts DownloadOptions) (DownloadResult, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return DownloadResult{}, err
+	}
+	conn, err := dialFTP(ctx, u, fo)
+	if err != nil {
+		return DownloadResult{}, err
+	}
+	defer conn.Quit()
+
+	remote := u.Path
+	total := int64(-1)
+	if n, serr := conn.FileSize(remote); serr == nil {
+		total = n
+	}
+	if opts.MaxSize > 0 && total > opts.MaxSize {
+		return DownloadResult{}, &ValidationError{Reason: fmt.Sprintf("文件大小%s超过上限%s", FormatBytes(total), FormatBytes(opts.MaxSize))}
+	}
+
+	modified := ftpModTime(conn, remote)
+
+	offset := resumeOffset(filepath, total, modified)
+	resp, err := conn.RetrFrom(remote, uint64(offset))
+	if err != nil {
+		return DownloadResult{}, err
+	}
+	defer resp.Close()
+	// 取消时让阻塞的读立即返回
+	stop := context.AfterFunc(ctx, func() { resp.SetDeadline(time.Now()) })
+	defer stop()
+
+	result, err := writeResumed(filepath, rawurl, &ctxReader{ctx: ctx, r: resp}, offset, total, opts)
+	if err != nil {
+		return result, err
+	}
+	result.LastModified = httpTime(modified)
+	return result, nil
+}
+
+// StatFTP 通过SIZE/MDTM获取FTP文件信息 服务器不支持MDTM时LastModified为空
+func StatFTP(ctx context.Context, rawurl string, fo FTPOptions) (RemoteInfo, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return RemoteInfo{}, err
+	}
+	conn, err := dialFTP(ctx, u, fo)
+	if err != nil {
+		return RemoteInfo{}, err
+	}
+	defer conn.Quit()
+
+	size, err := conn.FileSize(u.Path)
+	if err != nil {
+		return RemoteInfo{}, err
+	}
+	return RemoteInfo{Size: size, LastModified: httpTime(ftpModTime(conn, u.Path))}, nil
+}
+
+// MDTM修改时间 服务器不支持时为零值
+func ftpModTime(conn *ftp.ServerConn, remote string) time.Time {
+	if !conn.IsGetTimeSupported() {
+		return time.Time{}
+	}
+	t, err := conn.GetTime(remote)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// http.TimeFormat格式 与条件下载记录的Last-Modified一致 零值时为空
+func httpTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(http.TimeFormat)
+}
+
+// 已有未完成的filepath.part时返回其大小作为续传位置
+// 比远程文件大 或远程文件在.part最后写入之后被修改(.part为旧版本的内容)时重新下载 modified为零值时不比较
+func resumeOffset(filepath string, total int64, modified time.Time) int64 {
+	EnsureBaseDir(filepath)
+	fi, err := FS.Stat(filepath + ".part")
+	if err != nil {
+		return 0
+	}
+	if total >= 0 && fi.Size() > total {
+		return 0
+	}
+	if !modified.IsZero() && fi.ModTime().Before(modified) {
+		return 0
+	}
+	return fi.Size()
+}
+
+// 从offset处把body追加到.part 完整后校验大小并替换目标文件 中断时保留.part以便续传
+func writeResumed(filepath string, rawurl string, body io.Reader, offset int64, total int64, opts DownloadOptions) (DownloadResult, error) {
+	tmp := filepath + ".part"
+	br := bufio.NewReaderSize(body, 512)
+	if opts.Validate != nil {
+		head, err := partHead(tmp, offset, br)
+		if err != nil {
+			return DownloadResult{}, err
+		}
+		if err = opts.Validate("", head); err != nil {
+			FS.Remove(tmp)
+			return DownloadResult{}, err
+		}
+	}
+
+	flag := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if offset == 0 {
+		flag |= os.O_TRUNC
+	}
+	out, err := FS.OpenFile(tmp, flag)
+	if err != nil {
+		return DownloadResult{}, err
+	}
+
+	remain := int64(-1)
+	if total >= 0 {
+		remain = total - offset
+	}
+	var r io.Reader = NewProgressReader(br, filepath, remain, opts.ProgressInterval, opts.OnProgress)
+	if opts.MaxSize > 0 {
+		r = io.LimitReader(r, opts.MaxSize-offset+1)
+	}
+	_, err = io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return DownloadResult{}, err // 保留.part 下次续传
+	}
+
+	result := DownloadResult{}
+	result.Size, result.SHA256, err = HashFile(tmp)
+	if err != nil {
+		return DownloadResult{}, err
+	}
+	if opts.MaxSize > 0 && result.Size > opts.MaxSize {
+		FS.Remove(tmp)
+		return DownloadResult{}, &ValidationError{Reason: fmt.Sprintf("文件大小超过上限%s", FormatBytes(opts.MaxSize))}
+	}
+	if total >= 0 && result.Size != total {
+		return DownloadResult{}, fmt.Errorf("文件[%s]下载不完整 %d/%d", rawurl, result.Size, total)
+	}
+
+	if err = FS.Rename(tmp, filepath); err != nil {
+		FS.Remove(tmp)
+		return DownloadResult{}, err
+	}
+	return result, nil
+}
+
+// 文件开头的字节 续传时从.part读取
+func partHead(tmp string, offset int64, br *bufio.Reader) ([]byte, error) {
+	if offset == 0 {
+		head, _ := br.Peek(512)
+		return head, nil
+	}
+
+	f, err := FS.Open(tmp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	return head[:n], nil
+}
+
+func dialFTP(ctx context.Context, u *url.URL, fo FTPOptions) (*ftp.ServerConn, error) {
+	timeout := fo.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	host := u.Host
+	implicit := strings.EqualFold(u.Scheme, "ftps")
+	if len(u.Port()) == 0 {
+		if implicit {
+			host = net.JoinHostPort(u.Hostname(), "990")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "21")
+		}
+	}
+
+	dialOpts := []ftp.DialOption{ftp.DialWithContext(ctx), ftp.DialWithTimeout(timeout)}
+	tlsConfig := &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: fo.InsecureSkipVerify}
+	if implicit {
+		dialOpts = append(dialOpts, ftp.DialWithTLS(tlsConfig))
+	} else if fo.ExplicitTLS {
+		dialOpts = append(dialOpts, ftp.DialWithExplicitTLS(tlsConfig))
+	}
+
+	conn, err := ftp.Dial(host, dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	user, pass := fo.Username, fo.Password
+	if u.User != nil {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+	}
+	if len(user) == 0 {
+		user, pass = "anonymous", "anonymous"
+	}
+	if err = conn.Login(user, pass); err != nil {
+		conn.Quit()
+		return nil, err
+	}
+	return conn, nil
+}
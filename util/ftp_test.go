@@ -0,0 +1,118 @@
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ftpserver "github.com/fclairamb/ftpserverlib"
+	"github.com/spf13/afero"
+)
+
+// 进程内FTP服务器 用户名密码 test/test
+type testFTPDriver struct {
+	fs afero.Fs
+}
+
+func (d *testFTPDriver) GetSettings() (*ftpserver.Settings, error) {
+	return &ftpserver.Settings{ListenAddr: "127.0.0.1:0"}, nil
+}
+
+func (d *testFTPDriver) ClientConnected(cc ftpserver.ClientContext) (string, error) {
+	return "test ftp", nil
+}
+
+func (d *testFTPDriver) ClientDisconnected(cc ftpserver.ClientContext) {}
+
+func (d *testFTPDriver) AuthUser(cc ftpserver.ClientContext, user, pass string) (ftpserver.ClientDriver, error) {
+	if user != "test" || pass != "test" {
+		return nil, errors.New("bad credentials")
+	}
+	return d.fs, nil
+}
+
+func (d *testFTPDriver) GetTLSConfig() (*tls.Config, error) {
+	return nil, errors.New("no tls")
+}
+
+func startTestFTP(t *testing.T, files map[string]string) string {
+	fs := afero.NewMemMapFs()
+	for name, content := range files {
+		afero.WriteFile(fs, name, []byte(content), 0644)
+	}
+
+	srv := ftpserver.NewFtpServer(&testFTPDriver{fs: fs})
+	if err := srv.Listen(); err != nil {
+		t.Fatalf("ftp Listen() error = %v", err)
+	}
+	go srv.Serve()
+	t.Cleanup(func() { srv.Stop() })
+	return srv.Addr()
+}
+
+func TestDownloadFTP(t *testing.T) {
+	addr := startTestFTP(t, map[string]string{
+		"/docs/a.pdf":     "%PDF-1.4 0123456789",
+		"/docs/login.pdf": "<html>login</html>",
+	})
+	fo := FTPOptions{Username: "test", Password: "test"}
+	validate := func(contentType string, head []byte) error { return CheckContent("pdf", contentType, head) }
+	dir := t.TempDir()
+
+	// 完整下载
+	p := filepath.Join(dir, "a.pdf")
+	r, err := DownloadFTP(context.Background(), p, "ftp://"+addr+"/docs/a.pdf", fo, DownloadOptions{Validate: validate})
+	if err != nil {
+		t.Fatalf("DownloadFTP() error = %v", err)
+	}
+	if data, _ := os.ReadFile(p); string(data) != "%PDF-1.4 0123456789" || r.Size != 19 {
+		t.Errorf("DownloadFTP() got %q size %d", data, r.Size)
+	}
+
+	// 已有.part时续传
+	p2 := filepath.Join(dir, "b.pdf")
+	os.WriteFile(p2+".part", []byte("%PDF-1.4 "), 0644)
+	_, err = DownloadFTP(context.Background(), p2, "ftp://test:test@"+addr+"/docs/a.pdf", FTPOptions{}, DownloadOptions{Validate: validate})
+	if err != nil {
+		t.Fatalf("DownloadFTP() resume error = %v", err)
+	}
+	if data, _ := os.ReadFile(p2); string(data) != "%PDF-1.4 0123456789" {
+		t.Errorf("DownloadFTP() resume got %q", data)
+	}
+
+	// .part早于远程文件的修改时间(旧版本内容) 重新下载
+	p4 := filepath.Join(dir, "c.pdf")
+	os.WriteFile(p4+".part", []byte("%PDF-1.3 "), 0644)
+	old := time.Now().Add(-24 * time.Hour)
+	os.Chtimes(p4+".part", old, old)
+	_, err = DownloadFTP(context.Background(), p4, "ftp://"+addr+"/docs/a.pdf", fo, DownloadOptions{Validate: validate})
+	if err != nil {
+		t.Fatalf("DownloadFTP() stale part error = %v", err)
+	}
+	if data, _ := os.ReadFile(p4); string(data) != "%PDF-1.4 0123456789" {
+		t.Errorf("DownloadFTP() stale part got %q", data)
+	}
+
+	// HTML页面校验失败 不落盘
+	p3 := filepath.Join(dir, "login.pdf")
+	_, err = DownloadFTP(context.Background(), p3, "ftp://"+addr+"/docs/login.pdf", fo, DownloadOptions{Validate: validate})
+	var ve *ValidationError
+	if !errors.As(err, &ve) {
+		t.Errorf("DownloadFTP() error = %v, want ValidationError", err)
+	}
+	if _, serr := os.Stat(p3); serr == nil {
+		t.Errorf("DownloadFTP() stored invalid file")
+	}
+}
+
+func TestStatFTP(t *testing.T) {
+	addr := startTestFTP(t, map[string]string{"/docs/a.pdf": "%PDF-1.4 0123456789"})
+	info, err := StatFTP(context.Background(), "ftp://"+addr+"/docs/a.pdf", FTPOptions{Username: "test", Password: "test"})
+	if err != nil || info.Size != 19 || len(info.LastModified) == 0 {
+		t.Errorf("StatFTP() = %+v, %v", info, err)
+	}
+}
@@ -0,0 +1,100 @@
+package util
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const fileScheme = "file://"
+
+// FileUrl 本地/挂载路径转为file://<路径> 作为下载地址
+func FileUrl(p string) string {
+	return fileScheme + p
+}
+
+// IsFileUrl 是否为file://地址
+func IsFileUrl(rawurl string) bool {
+	return strings.HasPrefix(rawurl, fileScheme)
+}
+
+// 本地文件的ETag 由大小和修改时间生成 用于条件复制
+func localETag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.Size(), fi.ModTime().UnixNano())
+}
+
+// StatLocal 本地/挂载文件信息 与StatRemote一致
+func StatLocal(rawurl string) (RemoteInfo, error) {
+	fi, err := os.Stat(strings.TrimPrefix(rawurl, fileScheme))
+	if err != nil {
+		return RemoteInfo{}, err
+	}
+	return RemoteInfo{
+		Size:         fi.Size(),
+		ETag:         localETag(fi),
+		LastModified: fi.ModTime().UTC().Format(http.TimeFormat),
+	}, nil
+}
+
+// DownloadLocal 从本地/挂载路径复制文件落盘 与Download相同: 先写临时文件再替换 计算sha256 校验大小
+// IfNoneMatch与文件当前ETag一致时不复制
+func DownloadLocal(ctx context.Context, filepath string, rawurl string, opts DownloadOptions) (DownloadResult, error) {
+	src := strings.TrimPrefix(rawurl, fileScheme)
+	in, err := os.Open(src)
+	if err != nil {
+		return DownloadResult{}, err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return DownloadResult{}, err
+	}
+	result := DownloadResult{
+		ETag:         localETag(fi),
+		LastModified: fi.ModTime().UTC().Format(http.TimeFormat),
+	}
+	if len(opts.IfNoneMatch) > 0 && opts.IfNoneMatch == result.ETag {
+		result.NotModified = true
+		return result, nil
+	}
+	if opts.MaxSize > 0 && fi.Size() > opts.MaxSize {
+		return DownloadResult{}, &ValidationError{Reason: fmt.Sprintf("文件大小%s超过上限%s", FormatBytes(fi.Size()), FormatBytes(opts.MaxSize))}
+	}
+
+	br := bufio.NewReaderSize(in, 512)
+	if opts.Validate != nil {
+		head, _ := br.Peek(512)
+		if err = opts.Validate("", head); err != nil {
+			return DownloadResult{}, err
+		}
+	}
+
+	var r io.Reader = NewProgressReader(&ctxReader{ctx: ctx, r: br}, filepath, fi.Size(), opts.ProgressInterval, opts.OnProgress)
+	result.Size, result.SHA256, err = WriteFileAtomic(filepath, r)
+	if err != nil {
+		return DownloadResult{}, err
+	}
+	if result.Size != fi.Size() {
+		FS.Remove(filepath)
+		return DownloadResult{}, fmt.Errorf("文件[%s]复制不完整 %d/%d", src, result.Size, fi.Size())
+	}
+	return result, nil
+}
+
+// 复制过程中ctx取消时中止
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
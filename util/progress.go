@@ -0,0 +1,109 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Progress 下载进度 Total未知(无Content-Length)时为-1
+type Progress struct {
+	Name    string        `json:"name"`
+	Bytes   int64         `json:"bytes"`
+	Total   int64         `json:"total"`
+	Percent float64       `json:"percent"` // Total未知时为-1
+	Rate    float64       `json:"rate"`    // 平均速率 bytes/s
+	ETA     time.Duration `json:"eta"`     // Total未知时为-1
+	Done    bool          `json:"done"`
+}
+
+// ProgressFunc 进度回调
+type ProgressFunc func(p Progress)
+
+// ProgressReader 包装io.Reader 每隔interval回调一次进度 读到EOF时再回调一次
+type ProgressReader struct {
+	r          io.Reader
+	name       string
+	total      int64
+	read       int64
+	interval   time.Duration
+	start      time.Time
+	last       time.Time
+	onProgress ProgressFunc
+}
+
+// NewProgressReader 创建进度reader total<=0表示大小未知
+func NewProgressReader(r io.Reader, name string, total int64, interval time.Duration, fn ProgressFunc) *ProgressReader {
+	if total <= 0 {
+		total = -1
+	}
+	now := time.Now()
+	return &ProgressReader{
+		r:          r,
+		name:       name,
+		total:      total,
+		interval:   interval,
+		start:      now,
+		last:       now,
+		onProgress: fn,
+	}
+}
+
+func (pr *ProgressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.add(int64(n), err == io.EOF)
+	return n, err
+}
+
+// 累加已读字节数 到达间隔或done时回调
+func (pr *ProgressReader) add(n int64, done bool) {
+	pr.read += n
+	if pr.onProgress == nil {
+		return
+	}
+
+	now := time.Now()
+	if done {
+		pr.onProgress(pr.progress(now, true))
+	} else if pr.interval > 0 && now.Sub(pr.last) >= pr.interval {
+		pr.last = now
+		pr.onProgress(pr.progress(now, false))
+	}
+}
+
+func (pr *ProgressReader) progress(now time.Time, done bool) Progress {
+	p := Progress{
+		Name:    pr.name,
+		Bytes:   pr.read,
+		Total:   pr.total,
+		Percent: -1,
+		ETA:     -1,
+		Done:    done,
+	}
+
+	elapsed := now.Sub(pr.start).Seconds()
+	if elapsed > 0 {
+		p.Rate = float64(pr.read) / elapsed
+	}
+	if pr.total > 0 {
+		p.Percent = float64(pr.read) * 100 / float64(pr.total)
+		if p.Rate > 0 {
+			p.ETA = time.Duration(float64(pr.total-pr.read) / p.Rate * float64(time.Second))
+		}
+	}
+	return p
+}
+
+// FormatBytes 字节数转为可读格式 如 1.5GB
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
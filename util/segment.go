@@ -0,0 +1,170 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// 源服务器支持Range且文件大小达到阈值时分段下载
+func segmentable(resp *http.Response, opts DownloadOptions) bool {
+	return opts.Segments > 1 && opts.SegmentThreshold > 0 && resp.ContentLength >= opts.SegmentThreshold &&
+		strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes")
+}
+
+// 文件分为opts.Segments段并发下载到filepath.part.<i> 全部完成后按顺序合并 校验大小和sha256
+// 第0段复用已打开的响应 其余段使用Range请求 带If-Range保证各段来自同一版本的文件
+func downloadSegments(ctx context.Context, filepath string, url string, resp *http.Response, body io.Reader, result DownloadResult, opts DownloadOptions) (DownloadResult, error) {
+	total := resp.ContentLength
+	count := int64(opts.Segments)
+	size := (total + count - 1) / count
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	EnsureBaseDir(filepath)
+	progress := &segmentProgress{pr: NewProgressReader(nil, filepath, total, opts.ProgressInterval, opts.OnProgress)}
+	ifRange := result.ETag
+	if len(ifRange) == 0 || strings.HasPrefix(ifRange, "W/") {
+		ifRange = result.LastModified
+	}
+
+	parts := make([]string, 0, count)
+	errs := make(chan error, count)
+	var wg sync.WaitGroup
+	for i := int64(0); i < count && i*size < total; i++ {
+		start := i * size
+		end := start + size - 1
+		if end >= total {
+			end = total - 1
+		}
+		part := fmt.Sprintf("%s.part.%d", filepath, i)
+		parts = append(parts, part)
+
+		wg.Add(1)
+		go func(i, start, end int64, part string) {
+			defer wg.Done()
+			var err error
+			if i == 0 {
+				err = writeSegment(part, &ctxReader{ctx: ctx, r: body}, end+1, progress)
+			} else {
+				err = fetchSegment(ctx, part, url, start, end, ifRange, opts, progress)
+			}
+			if err != nil {
+				cancel()
+				errs <- err
+			}
+		}(i, start, end, part)
+	}
+	wg.Wait()
+	close(errs)
+	defer func() {
+		for _, part := range parts {
+			FS.Remove(part)
+		}
+	}()
+	if err := <-errs; err != nil {
+		return DownloadResult{}, err
+	}
+	progress.done()
+
+	// 按顺序合并各段
+	readers := make([]io.Reader, 0, len(parts))
+	for _, part := range parts {
+		f, err := FS.Open(part)
+		if err != nil {
+			return DownloadResult{}, err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	var err error
+	result.Size, result.SHA256, err = WriteFileAtomic(filepath, io.MultiReader(readers...))
+	if err != nil {
+		return DownloadResult{}, err
+	}
+	if result.Size != total {
+		FS.Remove(filepath)
+		return DownloadResult{}, fmt.Errorf("文件[%s]下载不完整 %d/%d", url, result.Size, total)
+	}
+	if sum := resp.Header.Get(HeaderSHA256); len(sum) > 0 && !strings.EqualFold(sum, result.SHA256) {
+		FS.Remove(filepath)
+		return DownloadResult{}, fmt.Errorf("文件[%s]sha256不一致 %s/%s", url, result.SHA256, sum)
+	}
+	return result, nil
+}
+
+// Range请求下载一段 源文件已变化(未返回206)时失败
+func fetchSegment(ctx context.Context, part string, url string, start int64, end int64, ifRange string, opts DownloadOptions, progress *segmentProgress) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if len(ifRange) > 0 {
+		req.Header.Set("If-Range", ifRange)
+	}
+	resp, err := httpClient(opts.Client).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent ||
+		!strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/", start, end)) {
+		return fmt.Errorf("文件[%s]分段下载失败(code[%d] %s)", url, resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+	return writeSegment(part, resp.Body, end-start+1, progress)
+}
+
+// 写入一段 读取want字节
+func writeSegment(part string, r io.Reader, want int64, progress *segmentProgress) error {
+	out, err := FS.OpenFile(part, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, &segmentReader{r: io.LimitReader(r, want), progress: progress})
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if n != want {
+		return fmt.Errorf("分段下载不完整 %s %d/%d", part, n, want)
+	}
+	return nil
+}
+
+// 各段共用的下载进度
+type segmentProgress struct {
+	mu sync.Mutex
+	pr *ProgressReader
+}
+
+func (sp *segmentProgress) add(n int64) {
+	sp.mu.Lock()
+	sp.pr.add(n, false)
+	sp.mu.Unlock()
+}
+
+func (sp *segmentProgress) done() {
+	sp.mu.Lock()
+	sp.pr.add(0, true)
+	sp.mu.Unlock()
+}
+
+type segmentReader struct {
+	r        io.Reader
+	progress *segmentProgress
+}
+
+func (s *segmentReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.progress.add(int64(n))
+	return n, err
+}
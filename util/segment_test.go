@@ -0,0 +1,65 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDownload_segments(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 10) + "abc")
+	var ranges int32
+	etag := `"v1"`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.Header.Get("Range")) > 0 {
+			atomic.AddInt32(&ranges, 1)
+		}
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "a.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	p := filepath.Join(t.TempDir(), "a.bin")
+	opts := DownloadOptions{Segments: 4, SegmentThreshold: 50}
+	r, err := Download(context.Background(), p, srv.URL, opts)
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if data, _ := os.ReadFile(p); !bytes.Equal(data, content) || r.Size != int64(len(content)) {
+		t.Errorf("Download() got %q size %d", data, r.Size)
+	}
+	if n := atomic.LoadInt32(&ranges); n != 3 {
+		t.Errorf("Download() range requests = %d, want 3", n)
+	}
+	if parts, _ := filepath.Glob(p + ".part*"); len(parts) > 0 {
+		t.Errorf("Download() left parts %v", parts)
+	}
+
+	// 低于阈值不分段
+	atomic.StoreInt32(&ranges, 0)
+	opts.SegmentThreshold = 1000
+	if _, err = Download(context.Background(), p, srv.URL, opts); err != nil || atomic.LoadInt32(&ranges) != 0 {
+		t.Errorf("Download() below threshold error = %v ranges = %d", err, ranges)
+	}
+
+	// 各段请求时文件已变化(If-Range不匹配返回200)时失败
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.Header.Get("Range")) > 0 {
+			w.Header().Set("ETag", `"v2"`)
+		} else {
+			w.Header().Set("ETag", `"v1"`)
+		}
+		http.ServeContent(w, r, "a.bin", time.Time{}, bytes.NewReader(content))
+	})
+	opts.SegmentThreshold = 50
+	if _, err = Download(context.Background(), p, srv.URL, opts); err == nil {
+		t.Errorf("Download() changed source error = nil")
+	}
+}
@@ -0,0 +1,293 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPOptions SSH连接选项 url中带用户名密码时以url为准
+type SFTPOptions struct {
+	Username       string
+	Password       string
+	PrivateKeyFile string        // 私钥文件 与密码可同时配置
+	Passphrase     string        // 私钥密码 可选
+	KnownHostsFile string        // known_hosts文件 校验服务器公钥
+	InsecureHost   bool          // 不校验服务器公钥 仅测试环境使用
+	Timeout        time.Duration // 连接超时 缺省30s
+}
+
+// IsSFTPUrl 是否为sftp://地址
+func IsSFTPUrl(rawurl string) bool {
+	return strings.HasPrefix(strings.ToLower(rawurl), "sftp://")
+}
+
+func sshClientConfig(so SFTPOptions) (*ssh.ClientConfig, error) {
+	auths := make([]ssh.AuthMethod, 0, 2)
+	if len(so.PrivateKeyFile) > 0 {
+		key, err := os.ReadFile(so.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		var signer ssh.Signer
+		if len(so.Passphrase) > 0 {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(so.Passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		auths = append(auths, ssh.PublicKeys(signer))
+	}
+	if len(so.Password) > 0 {
+		auths = append(auths, ssh.Password(so.Password))
+	}
+
+	var hostKey ssh.HostKeyCallback
+	switch {
+	case len(so.KnownHostsFile) > 0:
+		cb, err := knownhosts.New(so.KnownHostsFile)
+		if err != nil {
+			return nil, err
+		}
+		hostKey = cb
+	case so.InsecureHost:
+		hostKey = ssh.InsecureIgnoreHostKey()
+	default:
+		return nil, errors.New("sftp未配置knownHostsFile")
+	}
+
+	timeout := so.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return &ssh.ClientConfig{
+		User:            so.Username,
+		Auth:            auths,
+		HostKeyCallback: hostKey,
+		Timeout:         timeout,
+	}, nil
+}
+
+// 建立SSH连接并打开SFTP会话 关闭SFTP会话时一并关闭SSH连接
+func dialSFTP(ctx context.Context, addr string, so SFTPOptions) (*sftp.Client, error) {
+	config, err := sshClientConfig(so)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, serr := net.SplitHostPort(addr); serr != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	d := net.Dialer{Timeout: config.Timeout}
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(nc, addr, config)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	sshClient := ssh.NewClient(c, chans, reqs)
+
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	go func() {
+		client.Wait()
+		sshClient.Close()
+	}()
+	return client, nil
+}
+
+// DownloadSFTP 通过SFTP下载文件落盘 先写入filepath.part 中断后再次下载时从.part的大小处续传
+// opts中的MaxSize/Validate/进度回调同Download 条件下载选项不适用
+func DownloadSFTP(ctx context.Context, filepath string, rawurl string, so SFTPOptions, opts DownloadOptions) (DownloadResult, error) {
+	client, u, err := dialSFTPUrl(ctx, rawurl, so)
+	if err != nil {
+		return DownloadResult{}, err
+	}
+	defer client.Close()
+
+	f, err := client.Open(u.Path)
+	if err != nil {
+		return DownloadResult{}, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return DownloadResult{}, err
+	}
+	total := fi.Size()
+	if opts.MaxSize > 0 && total > opts.MaxSize {
+		return DownloadResult{}, &ValidationError{Reason: fmt.Sprintf("文件大小%s超过上限%s", FormatBytes(total), FormatBytes(opts.MaxSize))}
+	}
+
+	offset := resumeOffset(filepath, total, fi.ModTime())
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return DownloadResult{}, err
+	}
+	// 取消时关闭连接 让阻塞的读立即返回
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	defer stop()
+
+	result, err := writeResumed(filepath, rawurl, &ctxReader{ctx: ctx, r: f}, offset, total, opts)
+	if err != nil {
+		return result, err
+	}
+	result.LastModified = httpTime(fi.ModTime())
+	return result, nil
+}
+
+// StatSFTP 获取SFTP文件的大小和修改时间
+func StatSFTP(ctx context.Context, rawurl string, so SFTPOptions) (RemoteInfo, error) {
+	client, u, err := dialSFTPUrl(ctx, rawurl, so)
+	if err != nil {
+		return RemoteInfo{}, err
+	}
+	defer client.Close()
+
+	fi, err := client.Stat(u.Path)
+	if err != nil {
+		return RemoteInfo{}, err
+	}
+	return RemoteInfo{Size: fi.Size(), LastModified: httpTime(fi.ModTime())}, nil
+}
+
+// 按sftp://地址建立连接 url中带用户名密码时以url为准
+func dialSFTPUrl(ctx context.Context, rawurl string, so SFTPOptions) (*sftp.Client, *url.URL, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.User != nil {
+		so.Username = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			so.Password = p
+		}
+	}
+	client, err := dialSFTP(ctx, u.Host, so)
+	return client, u, err
+}
+
+// SFTPStore SFTP服务器作为落盘存储 连接断开后下次操作时重连
+type SFTPStore struct {
+	addr string
+	opts SFTPOptions
+
+	mu     sync.Mutex
+	client *sftp.Client
+}
+
+// NewSFTPStore 创建SFTP存储并建立连接 addr为host:port
+func NewSFTPStore(addr string, so SFTPOptions) (*SFTPStore, error) {
+	s := &SFTPStore{addr: addr, opts: so}
+	if _, err := s.conn(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SFTPStore) conn() (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		if _, err := s.client.Getwd(); err == nil {
+			return s.client, nil
+		}
+		s.client.Close()
+		s.client = nil
+	}
+
+	client, err := dialSFTP(context.Background(), s.addr, s.opts)
+	if err != nil {
+		return nil, err
+	}
+	s.client = client
+	return client, nil
+}
+
+// Close 关闭连接
+func (s *SFTPStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	err := s.client.Close()
+	s.client = nil
+	return err
+}
+
+func (s *SFTPStore) Stat(name string) (os.FileInfo, error) {
+	c, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	return c.Stat(name)
+}
+
+func (s *SFTPStore) Open(name string) (io.ReadCloser, error) {
+	c, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	return c.Open(name)
+}
+
+func (s *SFTPStore) OpenFile(name string, flag int) (io.WriteCloser, error) {
+	c, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	return c.OpenFile(name, flag)
+}
+
+func (s *SFTPStore) Rename(oldname string, newname string) error {
+	c, err := s.conn()
+	if err != nil {
+		return err
+	}
+	if err = c.PosixRename(oldname, newname); err == nil {
+		return nil
+	}
+	// 服务器不支持posix-rename时先删除目标文件
+	c.Remove(newname)
+	return c.Rename(oldname, newname)
+}
+
+func (s *SFTPStore) Remove(name string) error {
+	c, err := s.conn()
+	if err != nil {
+		return err
+	}
+	err = c.Remove(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	return err
+}
+
+func (s *SFTPStore) MkdirAll(dir string) error {
+	c, err := s.conn()
+	if err != nil {
+		return err
+	}
+	return c.MkdirAll(dir)
+}
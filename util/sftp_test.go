@@ -0,0 +1,220 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// 进程内SSH服务器 仅提供sftp子系统 用户名密码 test/test 返回地址和known_hosts文件
+func startTestSFTP(t *testing.T) (string, string) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "test" && string(pass) == "test" {
+				return nil, nil
+			}
+			return nil, errors.New("bad credentials")
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSSH(nc, config)
+		}
+	}()
+
+	addr := l.Addr().String()
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := "[127.0.0.1]:" + addr[len("127.0.0.1:"):] + " " + string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+	os.WriteFile(knownHosts, []byte(line), 0644)
+	return addr, knownHosts
+}
+
+func serveTestSSH(nc net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, creqs, err := nch.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range creqs {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					if srv, err := sftp.NewServer(ch); err == nil {
+						srv.Serve()
+					}
+					ch.Close()
+				}
+			}
+		}()
+	}
+}
+
+func TestDownloadSFTP(t *testing.T) {
+	addr, knownHosts := startTestSFTP(t)
+	src := filepath.Join(t.TempDir(), "a.pdf")
+	os.WriteFile(src, []byte("%PDF-1.4 0123456789"), 0644)
+	so := SFTPOptions{Username: "test", Password: "test", KnownHostsFile: knownHosts}
+	dir := t.TempDir()
+
+	// 已有.part时续传
+	p := filepath.Join(dir, "a.pdf")
+	os.WriteFile(p+".part", []byte("%PDF-1.4 "), 0644)
+	r, err := DownloadSFTP(context.Background(), p, "sftp://"+addr+src, so, DownloadOptions{})
+	if err != nil {
+		t.Fatalf("DownloadSFTP() error = %v", err)
+	}
+	if data, _ := os.ReadFile(p); string(data) != "%PDF-1.4 0123456789" || r.Size != 19 {
+		t.Errorf("DownloadSFTP() got %q size %d", data, r.Size)
+	}
+
+	info, err := StatSFTP(context.Background(), "sftp://"+addr+src, so)
+	if err != nil || info.Size != 19 || info.LastModified != r.LastModified {
+		t.Errorf("StatSFTP() = %+v, %v want LastModified %s", info, err, r.LastModified)
+	}
+
+	// 服务器公钥不在known_hosts中时拒绝连接
+	other := filepath.Join(t.TempDir(), "known_hosts")
+	os.WriteFile(other, nil, 0644)
+	so.KnownHostsFile = other
+	if _, err = DownloadSFTP(context.Background(), p, "sftp://"+addr+src, so, DownloadOptions{}); err == nil {
+		t.Errorf("DownloadSFTP() unknown host key error = nil")
+	}
+}
+
+func TestSFTPStore(t *testing.T) {
+	addr, knownHosts := startTestSFTP(t)
+	store, err := NewSFTPStore(addr, SFTPOptions{Username: "test", Password: "test", KnownHostsFile: knownHosts})
+	if err != nil {
+		t.Fatalf("NewSFTPStore() error = %v", err)
+	}
+	defer store.Close()
+
+	old := FS
+	FS = store
+	defer func() { FS = old }()
+
+	root := filepath.ToSlash(t.TempDir())
+	p := root + "/a/b/c.txt"
+	if _, _, err = WriteFileAtomic(p, bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatalf("WriteFileAtomic() error = %v", err)
+	}
+	if err = MoveFile(p, root+"/trash/c.txt"); err != nil {
+		t.Fatalf("MoveFile() error = %v", err)
+	}
+	f, err := FS.Open(root + "/trash/c.txt")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "hello" {
+		t.Errorf("got %q, want hello", data)
+	}
+	if err = DeleteFile(p); !os.IsNotExist(err) {
+		t.Errorf("DeleteFile() error = %v, want not exist", err)
+	}
+}
+
+// U/D对SFTP落盘文件的操作: U下载到.new 旧文件移入回收站后替换 D移入回收站
+func TestSFTPStore_updateDelete(t *testing.T) {
+	addr, knownHosts := startTestSFTP(t)
+	store, err := NewSFTPStore(addr, SFTPOptions{Username: "test", Password: "test", KnownHostsFile: knownHosts})
+	if err != nil {
+		t.Fatalf("NewSFTPStore() error = %v", err)
+	}
+	defer store.Close()
+
+	old := FS
+	FS = store
+	defer func() { FS = old }()
+
+	root := filepath.ToSlash(t.TempDir())
+	p := path.Join(root, "cnpc_dq", "X1-", "X1-2", "a.pdf")
+	if _, _, err = WriteFileAtomic(p, bytes.NewReader([]byte("v1"))); err != nil {
+		t.Fatalf("WriteFileAtomic() error = %v", err)
+	}
+
+	// U
+	if _, _, err = WriteFileAtomic(p+".new", bytes.NewReader([]byte("v2"))); err != nil {
+		t.Fatalf("WriteFileAtomic(.new) error = %v", err)
+	}
+	if _, err = FS.Stat(p); err != nil {
+		t.Fatalf("Stat() old file error = %v", err)
+	}
+	if err = MoveFile(p, path.Join(root, "trash", "1_a.pdf")); err != nil {
+		t.Fatalf("MoveFile() error = %v", err)
+	}
+	if err = FS.Rename(p+".new", p); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	if got := readStore(t, p); got != "v2" {
+		t.Errorf("after U got %q, want v2", got)
+	}
+	if got := readStore(t, path.Join(root, "trash", "1_a.pdf")); got != "v1" {
+		t.Errorf("trash after U got %q, want v1", got)
+	}
+
+	// D
+	if _, err = FS.Stat(p); err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if err = MoveFile(p, path.Join(root, "trash", "2_a.pdf")); err != nil {
+		t.Fatalf("MoveFile() error = %v", err)
+	}
+	if _, err = FS.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("Stat() after D error = %v, want not exist", err)
+	}
+	if got := readStore(t, path.Join(root, "trash", "2_a.pdf")); got != "v2" {
+		t.Errorf("trash after D got %q, want v2", got)
+	}
+}
+
+func readStore(t *testing.T, name string) string {
+	f, err := FS.Open(name)
+	if err != nil {
+		t.Fatalf("Open(%s) error = %v", name, err)
+	}
+	defer f.Close()
+	data, _ := io.ReadAll(f)
+	return string(data)
+}
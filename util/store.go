@@ -0,0 +1,46 @@
+package util
+
+import (
+	"io"
+	"os"
+)
+
+// Store 目标落盘存储 本地磁盘或SFTP服务器
+type Store interface {
+	Stat(name string) (os.FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	OpenFile(name string, flag int) (io.WriteCloser, error)
+	Rename(oldname string, newname string) error // 目标已存在时覆盖
+	Remove(name string) error
+	MkdirAll(dir string) error
+}
+
+// FS 落盘文件操作使用的存储 缺省为本地磁盘
+var FS Store = LocalStore{}
+
+// LocalStore 本地磁盘
+type LocalStore struct{}
+
+func (LocalStore) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (LocalStore) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (LocalStore) OpenFile(name string, flag int) (io.WriteCloser, error) {
+	return os.OpenFile(name, flag, 0644)
+}
+
+func (LocalStore) Rename(oldname string, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (LocalStore) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (LocalStore) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, 0755)
+}
@@ -1,45 +1,204 @@
 package util
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 // DownloadFile 下载文件落盘
 func DownloadFile(filepath string, url string) error {
+	_, err := Download(context.Background(), filepath, url, DownloadOptions{})
+	return err
+}
+
+// DownloadOptions 下载选项
+type DownloadOptions struct {
+	ProgressInterval time.Duration // 进度回调间隔
+	OnProgress       ProgressFunc  // 进度回调 可为nil
+	IfNoneMatch      string        // 条件下载 上次的ETag
+	IfModifiedSince  string        // 条件下载 上次的Last-Modified
+	MaxSize          int64         // 文件大小上限 0为不限
+	Client           *http.Client  // 为nil时使用带链路追踪的默认客户端
+	Segments         int           // 分段并发下载的段数 小于2时不分段 源服务器须支持Range
+	SegmentThreshold int64         // 文件大小达到该值时分段下载 0为不分段
+	// 写文件前按Content-Type和文件开头的字节校验内容 可为nil
+	Validate func(contentType string, head []byte) error
+}
+
+// DownloadResult 下载结果 NotModified为true时未写文件
+type DownloadResult struct {
+	NotModified  bool
+	Size         int64
+	ETag         string
+	LastModified string
+	SHA256       string
+}
+
+// Download 下载文件落盘 先写入临时文件 下载完整后再替换目标文件
+// 设置了IfNoneMatch/IfModifiedSince且源服务器返回304时不下载
+func Download(ctx context.Context, filepath string, url string, opts DownloadOptions) (DownloadResult, error) {
 	if len(url) == 0 {
-		return errors.New(fmt.Sprintf("文件下载url为空"))
+		return DownloadResult{}, errors.New(fmt.Sprintf("文件下载url为空"))
 	}
 
-	// Create the file
-	EnsureBaseDir(filepath)
-	out, err := os.Create(filepath)
+	// Get the data
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return err
+		return DownloadResult{}, err
 	}
-	defer out.Close()
-
-	// Get the data
-	resp, err := http.Get(url)
+	if len(opts.IfNoneMatch) > 0 {
+		req.Header.Set("If-None-Match", opts.IfNoneMatch)
+	}
+	if len(opts.IfModifiedSince) > 0 {
+		req.Header.Set("If-Modified-Since", opts.IfModifiedSince)
+	}
+	resp, err := httpClient(opts.Client).Do(req)
 	if err != nil {
-		return err
+		return DownloadResult{}, err
+	}
+	defer resp.Body.Close()
+
+	result := DownloadResult{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		result.NotModified = true
+		return result, nil
 	}
 	if resp.StatusCode != 200 {
-		return errors.New(fmt.Sprintf("文件[%s]下载失败(code[%d])，请检查用户密码是否正确", url, resp.StatusCode))
+		return DownloadResult{}, errors.New(fmt.Sprintf("文件[%s]下载失败(code[%d])，请检查用户密码是否正确", url, resp.StatusCode))
+	}
+
+	if opts.MaxSize > 0 && resp.ContentLength > opts.MaxSize {
+		return DownloadResult{}, &ValidationError{Reason: fmt.Sprintf("文件大小%s超过上限%s", FormatBytes(resp.ContentLength), FormatBytes(opts.MaxSize))}
+	}
+
+	// 校验文件开头 不合格时不落盘
+	br := bufio.NewReaderSize(resp.Body, 512)
+	if opts.Validate != nil {
+		head, _ := br.Peek(512)
+		if err = opts.Validate(resp.Header.Get("Content-Type"), head); err != nil {
+			return DownloadResult{}, err
+		}
+	}
+
+	// 大文件分段并发下载
+	if segmentable(resp, opts) {
+		return downloadSegments(ctx, filepath, url, resp, br, result, opts)
 	}
-	defer resp.Body.Close()
 
 	// Write the body to file
-	_, err = io.Copy(out, resp.Body)
+	var r io.Reader = NewProgressReader(br, filepath, resp.ContentLength, opts.ProgressInterval, opts.OnProgress)
+	if opts.MaxSize > 0 {
+		r = io.LimitReader(r, opts.MaxSize+1)
+	}
+	result.Size, result.SHA256, err = WriteFileAtomic(filepath, r)
 	if err != nil {
-		return err
+		return DownloadResult{}, err
+	}
+	if opts.MaxSize > 0 && result.Size > opts.MaxSize {
+		FS.Remove(filepath)
+		return DownloadResult{}, &ValidationError{Reason: fmt.Sprintf("文件大小超过上限%s", FormatBytes(opts.MaxSize))}
+	}
+	if resp.ContentLength >= 0 && result.Size != resp.ContentLength {
+		FS.Remove(filepath)
+		return DownloadResult{}, fmt.Errorf("文件[%s]下载不完整 %d/%d", url, result.Size, resp.ContentLength)
+	}
+	// 源服务器提供了sha256时校验
+	if sum := resp.Header.Get(HeaderSHA256); len(sum) > 0 && !strings.EqualFold(sum, result.SHA256) {
+		FS.Remove(filepath)
+		return DownloadResult{}, fmt.Errorf("文件[%s]sha256不一致 %s/%s", url, result.SHA256, sum)
 	}
 
-	return nil
+	return result, nil
+}
+
+// WriteFileAtomic 将r写入filepath.part 完成后重命名为filepath 返回大小和sha256
+func WriteFileAtomic(filepath string, r io.Reader) (int64, string, error) {
+	EnsureBaseDir(filepath)
+	tmp := filepath + ".part"
+	out, err := FS.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return 0, "", err
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, h), r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		FS.Remove(tmp)
+		return 0, "", err
+	}
+
+	if err = FS.Rename(tmp, filepath); err != nil {
+		FS.Remove(tmp)
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// RemoteInfo 远程文件信息 Size未知时为-1
+type RemoteInfo struct {
+	Size         int64
+	ETag         string
+	LastModified string
+}
+
+// StatRemote 通过HEAD请求获取远程文件信息 file://地址时为本地文件信息 client为nil时使用带链路追踪的默认客户端
+func StatRemote(ctx context.Context, url string, client *http.Client) (RemoteInfo, error) {
+	if len(url) == 0 {
+		return RemoteInfo{}, errors.New("文件url为空")
+	}
+	if IsFileUrl(url) {
+		return StatLocal(url)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return RemoteInfo{}, err
+	}
+	resp, err := httpClient(client).Do(req)
+	if err != nil {
+		return RemoteInfo{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return RemoteInfo{}, fmt.Errorf("HEAD[%s] code[%d]", url, resp.StatusCode)
+	}
+
+	return RemoteInfo{
+		Size:         resp.ContentLength,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// HeaderSHA256 源服务器返回文件sha256(hex)的响应头
+const HeaderSHA256 = "X-Content-Sha256"
+
+// 默认客户端 请求记录span并在请求头中传递trace上下文
+var tracedClient = &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+
+func httpClient(c *http.Client) *http.Client {
+	if c == nil {
+		return tracedClient
+	}
+	return c
 }
 
 // DeleteFile 删除已落盘的文件
@@ -48,7 +207,7 @@ func DeleteFile(filepath string) error {
 		return errors.New(fmt.Sprintf("删除的文件地址为空"))
 	}
 
-	err := os.Remove(filepath)
+	err := FS.Remove(filepath)
 	if err != nil {
 		return err
 	}
@@ -56,11 +215,57 @@ func DeleteFile(filepath string) error {
 	return nil
 }
 
+// MoveFile 移动文件 跨磁盘无法rename时复制后删除源文件
+func MoveFile(src string, dst string) error {
+	EnsureBaseDir(dst)
+	if err := FS.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := FS.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if _, _, err = WriteFileAtomic(dst, in); err != nil {
+		return err
+	}
+	in.Close()
+	return FS.Remove(src)
+}
+
+// CopyFile 复制文件 返回大小和sha256
+func CopyFile(src string, dst string) (int64, string, error) {
+	in, err := FS.Open(src)
+	if err != nil {
+		return 0, "", err
+	}
+	defer in.Close()
+	return WriteFileAtomic(dst, in)
+}
+
+// HashFile 计算文件大小和sha256
+func HashFile(filepath string) (int64, string, error) {
+	f, err := FS.Open(filepath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
 // EnsureBaseDir 确保文件所在目录已经创建
 func EnsureBaseDir(fpath string) {
 	baseDir := path.Dir(fpath)
-	_, err := os.Stat(baseDir)
+	_, err := FS.Stat(baseDir)
 	if err != nil {
-		os.MkdirAll(baseDir, 0755)
+		FS.MkdirAll(baseDir)
 	}
 }
@@ -0,0 +1,112 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownload_conditional(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2023 15:04:05 GMT")
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	p := filepath.Join(t.TempDir(), "a", "b.txt")
+	r, err := Download(context.Background(), p, srv.URL, DownloadOptions{})
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if r.NotModified || r.Size != 5 || r.ETag != `"v1"` || r.LastModified == "" ||
+		r.SHA256 != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("Download() result = %+v", r)
+	}
+	if _, err := os.Stat(p + ".part"); !os.IsNotExist(err) {
+		t.Errorf("Download() left temp file")
+	}
+
+	r, err = Download(context.Background(), p, srv.URL, DownloadOptions{IfNoneMatch: r.ETag})
+	if err != nil {
+		t.Fatalf("Download() conditional error = %v", err)
+	}
+	if !r.NotModified {
+		t.Errorf("Download() conditional NotModified = false")
+	}
+	if data, _ := os.ReadFile(p); string(data) != "hello" {
+		t.Errorf("Download() conditional changed file: %q", data)
+	}
+}
+
+func TestDownload_validate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login.pdf" {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte("<!DOCTYPE html><html><body>请登录</body></html>"))
+			return
+		}
+		w.Write([]byte("%PDF-1.4 0123456789"))
+	}))
+	defer srv.Close()
+
+	validate := func(contentType string, head []byte) error { return CheckContent("pdf", contentType, head) }
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		path    string
+		maxSize int64
+		wantErr bool
+	}{
+		{"pdf", "/a.pdf", 0, false},
+		{"html page", "/login.pdf", 0, true},
+		{"too large", "/a.pdf", 10, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(dir, tt.name+".pdf")
+			_, err := Download(context.Background(), p, srv.URL+tt.path, DownloadOptions{MaxSize: tt.maxSize, Validate: validate})
+			var ve *ValidationError
+			if (err != nil) != tt.wantErr || (err != nil && !errors.As(err, &ve)) {
+				t.Fatalf("Download() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, serr := os.Stat(p); (serr == nil) == tt.wantErr {
+				t.Errorf("file exists = %v, want %v", serr == nil, !tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDownloadLocal(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src.txt")
+	os.WriteFile(src, []byte("hello"), 0644)
+	p := filepath.Join(t.TempDir(), "a", "b.txt")
+
+	r, err := DownloadLocal(context.Background(), p, FileUrl(src), DownloadOptions{})
+	if err != nil {
+		t.Fatalf("DownloadLocal() error = %v", err)
+	}
+	if data, _ := os.ReadFile(p); string(data) != "hello" || r.Size != 5 ||
+		r.SHA256 != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("DownloadLocal() got %q %+v", data, r)
+	}
+
+	info, err := StatRemote(context.Background(), FileUrl(src), nil)
+	if err != nil || info.Size != 5 || info.ETag != r.ETag {
+		t.Errorf("StatRemote() = %+v, %v", info, err)
+	}
+
+	r2, err := DownloadLocal(context.Background(), p, FileUrl(src), DownloadOptions{IfNoneMatch: r.ETag})
+	if err != nil || !r2.NotModified {
+		t.Errorf("DownloadLocal() conditional = %+v, %v", r2, err)
+	}
+}
@@ -0,0 +1,71 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// ValidationError 文件内容校验失败 属于永久性错误 重试无意义
+type ValidationError struct {
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return "文件校验失败:" + e.Reason
+}
+
+// 二进制文档扩展名对应的文件头 同一扩展名可能有多种文件头
+var magicBytes = map[string][][]byte{
+	"pdf":  {[]byte("%PDF-")},
+	"docx": {[]byte("PK\x03\x04")},
+	"xlsx": {[]byte("PK\x03\x04")},
+	"pptx": {[]byte("PK\x03\x04")},
+	"zip":  {[]byte("PK\x03\x04"), []byte("PK\x05\x06")},
+	"ofd":  {[]byte("PK\x03\x04")},
+	"doc":  {[]byte("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1")},
+	"xls":  {[]byte("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1")},
+	"ppt":  {[]byte("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1")},
+	"png":  {[]byte("\x89PNG\r\n\x1A\n")},
+	"jpg":  {[]byte("\xFF\xD8\xFF")},
+	"jpeg": {[]byte("\xFF\xD8\xFF")},
+	"gif":  {[]byte("GIF87a"), []byte("GIF89a")},
+	"tif":  {[]byte("II*\x00"), []byte("MM\x00*")},
+	"tiff": {[]byte("II*\x00"), []byte("MM\x00*")},
+	"bmp":  {[]byte("BM")},
+	"rar":  {[]byte("Rar!\x1A\x07")},
+	"7z":   {[]byte("7z\xBC\xAF\x27\x1C")},
+	"gz":   {[]byte("\x1F\x8B")},
+}
+
+// IsBinaryExt 是否为已知文件头的二进制文档扩展名
+func IsBinaryExt(ext string) bool {
+	_, ok := magicBytes[strings.ToLower(ext)]
+	return ok
+}
+
+// CheckContent 按扩展名校验响应内容 head为文件开头的若干字节
+// 二进制文档不能是text/html响应或HTML页面 且文件头须与扩展名一致 未知扩展名不校验
+func CheckContent(ext string, contentType string, head []byte) error {
+	ext = strings.ToLower(ext)
+	magics, ok := magicBytes[ext]
+	if !ok {
+		return nil
+	}
+
+	if strings.HasPrefix(strings.ToLower(contentType), "text/html") || looksLikeHTML(head) {
+		return &ValidationError{Reason: fmt.Sprintf("%s文件返回了HTML页面(Content-Type:%s) 可能是登录页或错误页", ext, contentType)}
+	}
+	for _, m := range magics {
+		if bytes.HasPrefix(head, m) {
+			return nil
+		}
+	}
+	return &ValidationError{Reason: fmt.Sprintf("文件头与扩展名%s不符", ext)}
+}
+
+func looksLikeHTML(head []byte) bool {
+	s := bytes.TrimPrefix(head, []byte("\xEF\xBB\xBF"))
+	s = bytes.ToLower(bytes.TrimSpace(s))
+	return bytes.HasPrefix(s, []byte("<!doctype html")) || bytes.HasPrefix(s, []byte("<html"))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"prospect_file_sync/config"
+	"prospect_file_sync/util"
+)
+
+// 文件扩展名(小写 不含.) 文件名无扩展名时使用文档类型WDLX
+func fileExt(ft FileRow, job config.SyncJob) string {
+	name := path.Base(strings.ReplaceAll(ft.Str(job.PathColumn), "\\", "/"))
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(name)), ".")
+	if len(ext) == 0 {
+		ext = strings.ToLower(strings.TrimSpace(ft.Str("WDLX")))
+	}
+	return ext
+}
+
+// 按油田的扩展名白名单/黑名单校验 黑名单优先
+func checkExtension(vc config.ValidationConfig, ext string) error {
+	for _, e := range vc.DenyExt {
+		if strings.EqualFold(strings.TrimPrefix(e, "."), ext) {
+			return &util.ValidationError{Reason: fmt.Sprintf("扩展名%s在黑名单中", ext)}
+		}
+	}
+	if len(vc.AllowExt) == 0 {
+		return nil
+	}
+	for _, e := range vc.AllowExt {
+		if strings.EqualFold(strings.TrimPrefix(e, "."), ext) {
+			return nil
+		}
+	}
+	return &util.ValidationError{Reason: fmt.Sprintf("扩展名%s不在白名单中", ext)}
+}
+
+// 下载内容校验 按扩展名检查文件头及HTML页面
+func contentValidator(ext string) func(contentType string, head []byte) error {
+	return func(contentType string, head []byte) error {
+		return util.CheckContent(ext, contentType, head)
+	}
+}
+
+// 是否为内容校验失败 此类错误重试无意义
+func isPermanentError(err error) bool {
+	var ve *util.ValidationError
+	return errors.As(err, &ve)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"prospect_file_sync/config"
+	"prospect_file_sync/util"
+)
+
+const defaultVersionTable = "SYNC_FILE_VERSION"
+
+// 文档历史版本 U替换前的文件和目标库记录
+type fileVersion struct {
+	ID           string    `db:"ID" json:"id"`
+	Region       string    `db:"REGION" json:"region"`
+	Job          string    `db:"JOB" json:"job"`
+	TargetTable  string    `db:"TARGET_TABLE" json:"targetTable"`
+	DocKey       string    `db:"DOC_KEY" json:"docKey"` // FileLog.KeyString()
+	Keys         string    `db:"KEYS" json:"keys"`      // FileLog.Keys的JSON
+	OriginalPath string    `db:"ORIGINAL_PATH" json:"originalPath"`
+	VersionPath  string    `db:"VERSION_PATH" json:"versionPath"`
+	Sequence     string    `db:"SEQUENCE" json:"sequence"` // 替换该版本的log SEQUENCE$$ 手动操作时为空
+	FileSize     int64     `db:"FILE_SIZE" json:"fileSize"`
+	SHA256       string    `db:"SHA256" json:"sha256"`
+	RowData      string    `db:"ROW_DATA" json:"-"`
+	CreatedAt    time.Time `db:"CREATED_AT" json:"createdAt"`
+}
+
+func versionTable() string {
+	if len(cfg.Versioning.Table) > 0 {
+		return cfg.Versioning.Table
+	}
+	return defaultVersionTable
+}
+
+// 初始化目标库的历史版本表
+func ensureVersionTable() error {
+	return ensureTable(fmt.Sprintf(`CREATE TABLE "%s" (
+		ID VARCHAR2(40) PRIMARY KEY,
+		REGION VARCHAR2(100),
+		JOB VARCHAR2(100),
+		TARGET_TABLE VARCHAR2(100),
+		DOC_KEY VARCHAR2(1000),
+		KEYS VARCHAR2(2000),
+		ORIGINAL_PATH VARCHAR2(1000),
+		VERSION_PATH VARCHAR2(1000),
+		SEQUENCE VARCHAR2(40),
+		FILE_SIZE NUMBER,
+		SHA256 VARCHAR2(64),
+		ROW_DATA CLOB,
+		CREATED_AT DATE
+	)`, versionTable()))
+}
+
+// 旧文件移入历史版本目录 记录版本信息
+// 路径: <dir>/<油田>/<同步表>/<主键>/<id>_<文件名>
+func saveVersion(ctx context.Context, rc config.RegionConfig, job config.SyncJob, fl FileLog, row FileRow, storePath string) (err error) {
+	ctx, span := startSpan(ctx, "saveVersion", rc.Name, &fl)
+	defer func() { endSpan(span, err) }()
+
+	now := time.Now()
+	id := strconv.FormatInt(now.UnixNano(), 10)
+	docKey := fl.KeyString()
+	versionPath := path.Join(cfg.Versioning.Dir, rc.Name, job.Name, strings.ReplaceAll(docKey, "/", "_"),
+		id+"_"+path.Base(metaKey(storePath)))
+
+	keys, err := json.Marshal(fl.Keys)
+	if err != nil {
+		return err
+	}
+	data, err := encodeRow(row)
+	if err != nil {
+		return err
+	}
+	size, sum, err := util.HashFile(storePath)
+	if err != nil {
+		return err
+	}
+
+	if err = util.MoveFile(storePath, versionPath); err != nil {
+		return err
+	}
+
+	sqlStr := fmt.Sprintf(`INSERT INTO "%s" (ID, REGION, JOB, TARGET_TABLE, DOC_KEY, KEYS, ORIGINAL_PATH, VERSION_PATH, SEQUENCE, FILE_SIZE, SHA256, ROW_DATA, CREATED_AT)
+		VALUES (:1, :2, :3, :4, :5, :6, :7, :8, :9, :10, :11, :12, :13)`, versionTable())
+	_, err = targetDB.ExecContext(ctx, sqlStr, id, rc.Name, job.Name, job.TargetTable, docKey, string(keys),
+		storePath, versionPath, fl.SEQUENCE, size, sum, data, now)
+	if err != nil {
+		if merr := util.MoveFile(versionPath, storePath); merr != nil {
+			logger.Printf("%s saveVersion rollback error:%s\r\n", rc.Name, merr.Error())
+		}
+		return err
+	}
+	logger.Printf("%s saveVersion:%s -> %s\r\n", rc.Name, storePath, versionPath)
+	return nil
+}
+
+// 删除超过maxVersions的最旧版本
+func pruneVersions(ctx context.Context, region string, job string, docKey string) {
+	max := cfg.Versioning.MaxVersions
+	if max <= 0 {
+		return
+	}
+
+	list, err := listVersions(region, job, docKey)
+	if err != nil {
+		logger.Printf("%s pruneVersions error:%s\r\n", region, err.Error())
+		return
+	}
+	for i := max; i < len(list); i++ {
+		v := list[i]
+		if err = util.DeleteFile(v.VersionPath); err != nil && !os.IsNotExist(err) {
+			logger.Printf("%s pruneVersions DeleteFile error:%s\r\n", region, err.Error())
+			continue
+		}
+		_, err = targetDB.ExecContext(ctx, fmt.Sprintf(`DELETE FROM "%s" WHERE ID = :1`, versionTable()), v.ID)
+		if err != nil {
+			logger.Printf("%s pruneVersions delete record error:%s\r\n", region, err.Error())
+			continue
+		}
+		logger.Printf("%s pruneVersions:%s\r\n", region, v.VersionPath)
+	}
+}
+
+// 查询文档的历史版本 按时间倒序 region/job为空时不过滤
+func listVersions(region string, job string, docKey string) ([]fileVersion, error) {
+	list := []fileVersion{}
+	sqlStr := fmt.Sprintf(`SELECT ID, REGION, JOB, TARGET_TABLE, DOC_KEY, KEYS, ORIGINAL_PATH, VERSION_PATH, NVL(SEQUENCE, ' ') SEQUENCE, FILE_SIZE, SHA256, CREATED_AT
+		FROM "%s" WHERE DOC_KEY = :1 AND (:2 IS NULL OR REGION = :3) AND (:4 IS NULL OR JOB = :5) ORDER BY CREATED_AT DESC, ID DESC`, versionTable())
+	err := targetDB.Select(&list, sqlStr, docKey, region, region, job, job)
+	for i := range list {
+		list[i].Sequence = strings.TrimSpace(list[i].Sequence)
+	}
+	return list, err
+}
+
+func getVersion(id string) (fileVersion, error) {
+	var v fileVersion
+	sqlStr := fmt.Sprintf(`SELECT ID, REGION, JOB, TARGET_TABLE, DOC_KEY, KEYS, ORIGINAL_PATH, VERSION_PATH, NVL(SEQUENCE, ' ') SEQUENCE, FILE_SIZE, SHA256, ROW_DATA, CREATED_AT
+		FROM "%s" WHERE ID = :1`, versionTable())
+	err := targetDB.Get(&v, sqlStr, id)
+	v.Sequence = strings.TrimSpace(v.Sequence)
+	return v, err
+}
+
+// 恢复历史版本 当前文件先保存为一个新版本 再复制历史版本文件并写回其目标库记录
+// 历史版本本身保留 可再次恢复
+func restoreVersion(id string) error {
+	v, err := getVersion(id)
+	if err != nil {
+		return err
+	}
+	rc, ok := findRegion(v.Region)
+	if !ok {
+		return fmt.Errorf("region %s not found", v.Region)
+	}
+	job, ok := findJob(rc, v.Job)
+	if !ok {
+		return fmt.Errorf("job %s not found", v.Job)
+	}
+
+	fl := FileLog{}
+	if err = json.Unmarshal([]byte(v.Keys), &fl.Keys); err != nil {
+		return err
+	}
+	row, err := decodeRow(v.RowData)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	cur, err := queryTargetFile(ctx, targetDB, v.TargetTable, rowColumns(row), fl)
+	if err == nil {
+		curPath := ftpToStorePath(cur.Str(job.PathColumn))
+		if _, serr := util.FS.Stat(curPath); serr == nil {
+			if err = saveVersion(ctx, rc, job, fl, cur, curPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, _, err = util.CopyFile(v.VersionPath, v.OriginalPath); err != nil {
+		return err
+	}
+	if err = deleteFileMeta(ctx, v.OriginalPath); err != nil {
+		logger.Printf("%s deleteFileMeta[restoreVersion] error:%s\r\n", v.Region, err.Error())
+	}
+
+	if err = deleteFileRecord(ctx, targetDB, fl, v.TargetTable); err != nil {
+		logger.Printf("%s deleteFileRecord[restoreVersion] error:%s\r\n", v.Region, err.Error())
+	}
+	if err = insertFileRecord(ctx, targetDB, row, rowColumns(row), v.TargetTable); err != nil {
+		return err
+	}
+
+	logger.Printf("%s restoreVersion:%s -> %s\r\n", v.Region, v.VersionPath, v.OriginalPath)
+	pruneVersions(ctx, v.Region, v.Job, v.DocKey)
+	return nil
+}